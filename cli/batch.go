@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// runUpBatch mounts every target listed in run.file with one request, which
+// the daemon carries out concurrently. Each line is a target, an optional
+// mountpoint and flags for that target alone; blank lines and lines
+// starting with # are skipped. Every line is checked before anything is
+// mounted.
+func runUpBatch(run upRun) error {
+	if run.dryRun || run.foreground {
+		return errors.New("-f cannot be combined with --dry-run or --foreground")
+	}
+	var in io.Reader = os.Stdin
+	if run.file != "-" {
+		f, err := os.Open(run.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var batch []Command
+	scanner := bufio.NewScanner(in)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "-") {
+			return fmt.Errorf("%s:%d: a line starts with the target, flags follow it", run.file, line)
+		}
+		// The flag package stops at the first argument that is not a
+		// flag, so the target and mountpoint go last.
+		positional := fields[:1]
+		if len(fields) > 1 && !strings.HasPrefix(fields[1], "-") {
+			positional = fields[:2]
+		}
+		args := append(slices.Clone(run.batchFlags), fields[len(positional):]...)
+		cmd, lineRun, err := parseUp(append(args, positional...))
+		if err == nil && lineRun.file != "" {
+			err = errors.New("-f cannot be nested")
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", run.file, line, err)
+		}
+		batch = append(batch, cmd)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch) == 0 {
+		return fmt.Errorf("%s lists no targets", run.file)
+	}
+
+	start := time.Now()
+	resp := SendCmd(Command{Type: "up", Batch: batch})
+	verbosef("up of %d targets took %v", len(batch), time.Since(start).Round(time.Millisecond))
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	failed := len(resp.Failed)
+	for _, m := range resp.Mounts {
+		if run.wait {
+			if err := waitUsable(m, run.waitTimeout); err != nil {
+				fmt.Println("Error:", err)
+				failed++
+				continue
+			}
+		}
+		printMount(m)
+	}
+	for _, f := range resp.Failed {
+		fmt.Println("Error:", f)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d targets failed", failed, len(batch))
+	}
+	return nil
+}
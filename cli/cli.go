@@ -2,22 +2,37 @@ package cli
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	rfsmount "rfs/mount"
+	"rfs/ssh"
 )
 
 var stateDir string
 var binaryName string
 
+// init resolves the state directory: $RFS_STATE_DIR when set, ~/.rfs
+// otherwise. The daemon inherits the environment of the CLI that starts it,
+// so both sides agree on the socket path.
 func init() {
-	home, _ := os.UserHomeDir()
-	stateDir = filepath.Join(home, ".rfs")
+	stateDir = os.Getenv("RFS_STATE_DIR")
+	if stateDir == "" {
+		home, _ := os.UserHomeDir()
+		stateDir = filepath.Join(home, ".rfs")
+	}
+	stateDir, _ = filepath.Abs(stateDir)
 	binaryName = filepath.Base(os.Args[0])
 	if binaryName == "." || binaryName == "" {
 		binaryName = "rfs"
@@ -26,29 +41,121 @@ func init() {
 
 type Command struct {
 	Type       string   `json:"type"`
+	Name       string   `json:"name,omitempty"`
 	Names      []string `json:"names,omitempty"`
 	SSHAlias   string   `json:"sshAlias"`
 	RemotePath string   `json:"remotePath"`
 	MountDir   string   `json:"mountDir,omitempty"`
+	MountBase  string   `json:"mountBase,omitempty"`
+	Port       string   `json:"port,omitempty"`
+	All        bool     `json:"all,omitempty"`
+
+	InitialBackoff time.Duration `json:"initialBackoff,omitempty"`
+	MaxBackoff     time.Duration `json:"maxBackoff,omitempty"`
+	WaitForNetwork time.Duration `json:"waitForNetwork,omitempty"`
+	MountTemplate  string        `json:"mountTemplate,omitempty"`
+	Limit          int64         `json:"limit,omitempty"`
+	Bind           string        `json:"bind,omitempty"`
+	Export         bool          `json:"export,omitempty"`
+	Auth           string        `json:"auth,omitempty"`
+	CwdFromShell   bool          `json:"cwdFromShell,omitempty"`
+	Pre            string        `json:"pre,omitempty"`
+	LogLevel       string        `json:"logLevel,omitempty"`
+	Ignore         []string      `json:"ignore,omitempty"`
+	NoVerify       bool          `json:"noVerify,omitempty"`
+	FollowSymlinks bool          `json:"followSymlinks,omitempty"`
+	EffectivePerms bool          `json:"effectivePerms,omitempty"`
+	ExactLinks     bool          `json:"exactLinks,omitempty"`
+	Replace        bool          `json:"replace,omitempty"`
+	IdleTimeout    time.Duration `json:"idleTimeout,omitempty"`
+	OpTimeout      time.Duration `json:"opTimeout,omitempty"`
+	AdjustMtime    bool          `json:"adjustMtime,omitempty"`
+	Symlinks       string        `json:"symlinks,omitempty"`
+	Frontend       string        `json:"frontend,omitempty"`
+	PasswordFile   string        `json:"passwordFile,omitempty"`
+	IdentityFile   string        `json:"identityFile,omitempty"`
+	IdentitiesOnly bool          `json:"identitiesOnly,omitempty"`
+	SFTPServer     string        `json:"sftpServer,omitempty"`
+	ReadCacheSize  int64         `json:"readCacheSize,omitempty"`
+	Token          string        `json:"token,omitempty"`
+	NoCache        bool          `json:"noCache,omitempty"`
+	Force          bool          `json:"force,omitempty"`
+	Into           bool          `json:"into,omitempty"`
+	Argv           []string      `json:"argv,omitempty"`
+	LogMode        string        `json:"logMode,omitempty"`
+	LogFiles       int           `json:"logFiles,omitempty"`
+	MaxLogSize     int64         `json:"maxLogSize,omitempty"`
+	Prewarm        int           `json:"prewarm,omitempty"`
+	ReadOnly       bool          `json:"readOnly,omitempty"`
+	RSize          int           `json:"rsize,omitempty"`
+	WSize          int           `json:"wsize,omitempty"`
+	KeepDir        bool          `json:"keepDir,omitempty"`
+	DryRun         bool          `json:"dryRun,omitempty"`
+
+	BackgroundKeepalive bool          `json:"backgroundKeepalive,omitempty"`
+	KeepaliveInterval   time.Duration `json:"keepaliveInterval,omitempty"`
+	KeepaliveCountMax   int           `json:"keepaliveCountMax,omitempty"`
+	ConnectTimeout      time.Duration `json:"connectTimeout,omitempty"`
+
+	// Batch holds the mounts of an up -f, started together.
+	Batch []Command `json:"batch,omitempty"`
 }
 
 type Response struct {
-	OK     bool         `json:"ok"`
-	Error  string       `json:"error,omitempty"`
-	Mount  *MountInfo   `json:"mount,omitempty"`
-	Mounts []*MountInfo `json:"mounts,omitempty"`
-	Names  []string     `json:"names,omitempty"`
+	OK     bool          `json:"ok"`
+	Error  string        `json:"error,omitempty"`
+	Mount  *MountInfo    `json:"mount,omitempty"`
+	Mounts []*MountInfo  `json:"mounts,omitempty"`
+	Names  []string      `json:"names,omitempty"`
+	Stats  []*MountStats `json:"stats,omitempty"`
+	Failed []string      `json:"failed,omitempty"`
+	Hash   string        `json:"hash,omitempty"`
+
+	// Previous is the mount an up --replace took the place of.
+	Previous *MountInfo `json:"previous,omitempty"`
+}
+
+type MountStats struct {
+	Name string `json:"name"`
+	ssh.Stats
+
+	// ReadRate and WriteRate are bytes per second over the last few seconds.
+	ReadRate  float64 `json:"readRate"`
+	WriteRate float64 `json:"writeRate"`
 }
 
 type MountInfo struct {
-	Name       string    `json:"name"`
-	PID        int       `json:"pid"`
-	Port       string    `json:"port"`
-	MountDir   string    `json:"mountDir"`
-	SSHAlias   string    `json:"sshAlias"`
-	RemotePath string    `json:"remotePath"`
-	StartedAt  time.Time `json:"startedAt"`
-	LogFile    string    `json:"logFile"`
+	Name     string `json:"name"`
+	PID      int    `json:"pid"`
+	Port     string `json:"port"`
+	Address  string `json:"address"`
+	Export   bool   `json:"export,omitempty"`
+	Frontend string `json:"frontend,omitempty"`
+	// PasswordFile holds the password WebDAV clients log in with.
+	PasswordFile string    `json:"passwordFile,omitempty"`
+	MountDir     string    `json:"mountDir"`
+	SSHAlias     string    `json:"sshAlias"`
+	RemotePath   string    `json:"remotePath"`
+	StartedAt    time.Time `json:"startedAt"`
+	LogFile      string    `json:"logFile"`
+
+	InitialBackoff time.Duration `json:"initialBackoff"`
+	MaxBackoff     time.Duration `json:"maxBackoff"`
+	IdleTimeout    time.Duration `json:"idleTimeout,omitempty"`
+	ReadOnly       bool          `json:"readOnly,omitempty"`
+	RSize          int           `json:"rsize,omitempty"`
+	WSize          int           `json:"wsize,omitempty"`
+	ClockSkew      string        `json:"clockSkew,omitempty"` // server clock minus local, measured at mount time
+	AdjustMtime    bool          `json:"adjustMtime,omitempty"`
+
+	// Filled in by ls and inspect.
+	Mounted   bool `json:"mounted,omitempty"`
+	Connected bool `json:"connected,omitempty"`
+	Flapping  bool `json:"flapping,omitempty"`
+
+	// Filled in by inspect only.
+	Uptime string        `json:"uptime,omitempty"`
+	Health []HealthEvent `json:"health,omitempty"`
 }
 
 func StateDir() string {
@@ -59,37 +166,85 @@ func BinaryName() string {
 	return binaryName
 }
 
-func connect() net.Conn {
+func connect() (net.Conn, error) {
+	if remote := os.Getenv("RFS_DAEMON"); remote != "" {
+		addr, ok := strings.CutPrefix(remote, "tcp://")
+		if !ok {
+			return nil, fmt.Errorf("RFS_DAEMON must be tcp://host:port, not %q", remote)
+		}
+		return net.Dial("tcp", addr)
+	}
+
 	socketPath := filepath.Join(stateDir, "daemon.sock")
 	conn, err := net.Dial("unix", socketPath)
+	if err == nil {
+		return conn, nil
+	}
+
+	exited, errFile, err := startDaemon()
 	if err != nil {
-		startDaemon()
-		for range 20 {
-			time.Sleep(50 * time.Millisecond)
-			conn, err = net.Dial("unix", socketPath)
-			if err == nil {
-				return conn
+		return nil, fmt.Errorf("start daemon: %w", err)
+	}
+	defer os.Remove(errFile)
+	for range 20 {
+		time.Sleep(50 * time.Millisecond)
+		conn, err = net.Dial("unix", socketPath)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-exited:
+			// Another daemon may have won the race to start.
+			if conn, err := net.Dial("unix", socketPath); err == nil {
+				return conn, nil
 			}
+			msg, _ := os.ReadFile(errFile)
+			if s := strings.TrimSpace(string(msg)); s != "" {
+				return nil, fmt.Errorf("daemon failed to start: %s", s)
+			}
+			return nil, fmt.Errorf("daemon exited during startup")
+		default:
 		}
-		return nil
 	}
-	return conn
+	return nil, fmt.Errorf("daemon did not start listening on %s", socketPath)
 }
 
-func startDaemon() {
-	execPath, _ := os.Executable()
+// startDaemon launches the daemon with stderr going to a temporary file, so
+// connect can report why it exited if it never comes up. exited is closed
+// when the daemon process ends.
+func startDaemon() (exited chan struct{}, errFile string, err error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.CreateTemp("", "rfs-daemon-*.err")
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
 	cmd := exec.Command(execPath, "daemon")
-	cmd.Stderr = os.Stderr
-	cmd.Start()
+	cmd.Stderr = f
+	if err := cmd.Start(); err != nil {
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	exited = make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return exited, f.Name(), nil
 }
 
 func SendCmd(cmd Command) *Response {
-	conn := connect()
-	if conn == nil {
-		return &Response{Error: "daemon not running"}
+	conn, err := connect()
+	if err != nil {
+		return &Response{Error: err.Error()}
 	}
 	defer conn.Close()
 
+	cmd.Token = os.Getenv("RFS_TOKEN")
 	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
 		return &Response{Error: err.Error()}
 	}
@@ -99,8 +254,30 @@ func SendCmd(cmd Command) *Response {
 	return &resp
 }
 
+// quiet and verbose are the global --quiet and --verbose flags.
+var quiet, verbose bool
+
+// status prints a progress or success message unless --quiet is set.
+func status(a ...any) {
+	if !quiet {
+		fmt.Println(a...)
+	}
+}
+
+// verbosef prints extra detail to stderr when --verbose is set.
+func verbosef(format string, a ...any) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
 func RunCLI() {
-	args := os.Args[1:]
+	global := flag.NewFlagSet(binaryName, flag.ExitOnError)
+	global.BoolVar(&quiet, "quiet", false, "print only errors; rely on the exit code")
+	global.BoolVar(&verbose, "verbose", false, "print resolved ssh config and step timings to stderr")
+	global.Usage = PrintUsage
+	global.Parse(os.Args[1:])
+	args := global.Args()
 	if len(args) < 1 {
 		PrintUsage()
 		os.Exit(1)
@@ -111,23 +288,65 @@ func RunCLI() {
 
 	switch cmd {
 	case "up":
-		if (len(args) < 1) || (len(args) > 2) {
-			fmt.Println("Usage:", binaryName, "up <alias>[:<path>] [mountpoint]")
+		upCmd, run, err := parseUp(args)
+		if err != nil {
+			fmt.Println("Error:", err)
 			os.Exit(1)
 		}
-		alias, path := ParseTarget(args[0])
-		mountDir := ""
-		if len(args) == 2 {
-			mountDir = args[1]
+		if run.file != "" {
+			if err := runUpBatch(run); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+		alias := upCmd.SSHAlias
+		if run.dryRun {
+			if err := runDryRun(upCmd); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if run.foreground {
+			if err := RunForeground(upCmd); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if verbose {
+			if hc, err := ssh.LookupConfig(alias); err == nil {
+				verbosef("%s: %s@%s port %s, agents [%s], keys [%s]", alias, hc.User, hc.Hostname, hc.Port, strings.Join(hc.IdentityAgents, ", "), strings.Join(hc.IdentityFiles, ", "))
+			}
 		}
-		resp := SendCmd(Command{Type: "up", SSHAlias: alias, RemotePath: path, MountDir: mountDir})
+		start := time.Now()
+		resp := SendCmd(upCmd)
+		verbosef("up took %v", time.Since(start).Round(time.Millisecond))
 		if resp.Error != "" {
 			fmt.Println("Error:", resp.Error)
 			os.Exit(1)
 		}
-		fmt.Printf("%s:%s  port:%s  %s\n", resp.Mount.SSHAlias, resp.Mount.RemotePath, resp.Mount.Port, resp.Mount.MountDir)
+		if run.wait {
+			if err := waitUsable(resp.Mount, run.waitTimeout); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			verbosef("usable after %v", time.Since(start).Round(time.Millisecond))
+		}
+		if resp.Previous != nil {
+			status("replaced", resp.Previous.Name, "(port "+resp.Previous.Port+")")
+		}
+		printMount(resp.Mount)
 
 	case "ls":
+		flags := flag.NewFlagSet("ls", flag.ExitOnError)
+		sortBy := flags.String("sort", "name", "order mounts by name (alias, then path), uptime (longest first) or port")
+		flags.Parse(args)
+		if !slices.Contains([]string{"name", "uptime", "port"}, *sortBy) {
+			fmt.Println("Error: --sort must be name, uptime or port")
+			os.Exit(1)
+		}
 		resp := SendCmd(Command{Type: "ls"})
 		if resp.Error != "" {
 			fmt.Println("Error:", resp.Error)
@@ -137,23 +356,43 @@ func RunCLI() {
 			fmt.Println("No mounts")
 			return
 		}
-		fmt.Printf("%-20s %-6s %s\n", "ALIAS:PATH", "PORT", "MOUNT")
-		for _, m := range resp.Mounts {
-			fmt.Printf("%-20s %-6s %s\n", m.SSHAlias+":"+m.RemotePath, m.Port, m.MountDir)
-		}
+		sortMounts(resp.Mounts, *sortBy)
+		printMountTable(resp.Mounts)
+
+	case "down", "unmount":
+		flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+		all := flags.Bool("all", false, "stop every mount")
+		port := flags.String("port", "", "stop the mount served on this port")
+		exact := flags.String("name", "", "stop the mount with this exact name as shown by ls")
+		flags.Parse(args)
+		args = flags.Args()
 
-	case "down":
 		var names []string
 		for _, arg := range args {
 			names = append(names, ResolveMountName(arg))
 		}
-		resp := SendCmd(Command{Type: "down", Names: names})
+		if *exact != "" {
+			names = append(names, *exact)
+		}
+		if len(names) == 0 && *port == "" && !*all {
+			fmt.Println("Error: no mount given; use --all to stop every mount")
+			fmt.Println("Usage:", binaryName, cmd, "[--all] [--port <port>] [--name <name>] [<alias>[:<path>]...]")
+			os.Exit(1)
+		}
+		resp := SendCmd(Command{Type: "down", Names: names, Port: *port, All: *all, KeepDir: cmd == "unmount"})
 		if resp.Error != "" {
 			fmt.Println("Error:", resp.Error)
 			os.Exit(1)
 		}
 		for _, n := range resp.Names {
-			fmt.Println(n, "stopped")
+			status(n, "stopped")
+		}
+		for _, f := range resp.Failed {
+			fmt.Println("Warning: could not unmount", f)
+		}
+		if len(resp.Failed) > 0 {
+			fmt.Println("Close any shells or programs using these directories, then run umount on them.")
+			os.Exit(1)
 		}
 
 	case "logs":
@@ -163,6 +402,18 @@ func RunCLI() {
 		}
 		name := ResolveMountName(args[0])
 		logFile := filepath.Join(stateDir, "tmp", name+".log")
+		rotated, _ := filepath.Glob(logFile + ".*")
+		sort.Slice(rotated, func(i, j int) bool {
+			ni, _ := strconv.Atoi(strings.TrimPrefix(rotated[i], logFile+"."))
+			nj, _ := strconv.Atoi(strings.TrimPrefix(rotated[j], logFile+"."))
+			return ni > nj
+		})
+		for _, p := range rotated {
+			if f, err := os.Open(p); err == nil {
+				io.Copy(os.Stdout, f)
+				f.Close()
+			}
+		}
 		f, err := os.Open(logFile)
 		if err != nil {
 			fmt.Println("Error:", err)
@@ -171,36 +422,557 @@ func RunCLI() {
 		io.Copy(os.Stdout, f)
 		f.Close()
 
+	case "get":
+		runGet(args)
+
+	case "exec":
+		runExec(args)
+
+	case "hash":
+		runHash(args)
+
+	case "open":
+		if len(args) != 1 {
+			fmt.Println("Usage:", binaryName, "open <alias>[:<path>]")
+			os.Exit(1)
+		}
+		name := ResolveMountName(args[0])
+		resp := SendCmd(Command{Type: "ls"})
+		if resp.Error != "" {
+			fmt.Println("Error:", resp.Error)
+			os.Exit(1)
+		}
+		var mount *MountInfo
+		for _, m := range resp.Mounts {
+			if m.Name == name {
+				mount = m
+			}
+		}
+		if mount == nil {
+			fmt.Printf("%s is not mounted. Mount it now? [y/N] ", args[0])
+			var answer string
+			fmt.Scanln(&answer)
+			if answer != "y" && answer != "Y" {
+				os.Exit(1)
+			}
+			alias, path := ParseTarget(args[0])
+			resp = SendCmd(Command{Type: "up", SSHAlias: alias, RemotePath: path})
+			if resp.Error != "" {
+				fmt.Println("Error:", resp.Error)
+				os.Exit(1)
+			}
+			printMount(resp.Mount)
+			mount = resp.Mount
+		}
+		opener := "xdg-open"
+		if runtime.GOOS == "darwin" {
+			opener = "open"
+		}
+		if err := exec.Command(opener, mount.MountDir).Run(); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+	case "doctor":
+		runDoctor(args)
+
+	case "stats":
+		var names []string
+		for _, arg := range args {
+			names = append(names, ResolveMountName(arg))
+		}
+		resp := SendCmd(Command{Type: "stats", Names: names})
+		if resp.Error != "" {
+			fmt.Println("Error:", resp.Error)
+			os.Exit(1)
+		}
+		if len(resp.Stats) == 0 {
+			fmt.Println("No mounts")
+			return
+		}
+		fmt.Printf("%-20s %10s %10s %10s %10s %8s %8s %8s %6s\n", "NAME", "READ", "WRITTEN", "READ/S", "WRITE/S", "OPENS", "STATS", "READDIRS", "CACHE")
+		for _, st := range resp.Stats {
+			fmt.Printf("%-20s %10s %10s %10s %10s %8d %8d %8d %5.0f%%\n", st.Name, formatBytes(st.BytesRead), formatBytes(st.BytesWritten),
+				formatBytes(int64(st.ReadRate)), formatBytes(int64(st.WriteRate)), st.Opens, st.Stats.Stats, st.ReadDirs, st.CacheHitRatio()*100)
+		}
+
+	case "refresh":
+		if len(args) != 1 {
+			fmt.Println("Usage:", binaryName, "refresh <alias>[:<path>]")
+			os.Exit(1)
+		}
+		resp := SendCmd(Command{Type: "refresh", Name: ResolveMountName(args[0])})
+		if resp.Error != "" {
+			fmt.Println("Error:", resp.Error)
+			os.Exit(1)
+		}
+		status(resp.Mount.Name, "refreshed")
+
+	case "reconnect":
+		if len(args) != 1 {
+			fmt.Println("Usage:", binaryName, "reconnect <alias>[:<path>]")
+			os.Exit(1)
+		}
+		resp := SendCmd(Command{Type: "reconnect", Name: ResolveMountName(args[0])})
+		if resp.Error != "" {
+			fmt.Println("Error:", resp.Error)
+			os.Exit(1)
+		}
+		status(resp.Mount.Name, "reconnected")
+
+	case "gc":
+		flags := flag.NewFlagSet("gc", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+		flags.Parse(args)
+		if flags.NArg() > 0 {
+			fmt.Println("Usage:", binaryName, "gc [--dry-run]")
+			os.Exit(1)
+		}
+		resp := SendCmd(Command{Type: "gc", DryRun: *dryRun})
+		if resp.Error != "" {
+			fmt.Println("Error:", resp.Error)
+			os.Exit(1)
+		}
+		verb := "removed"
+		if *dryRun {
+			verb = "would remove"
+		}
+		for _, p := range resp.Names {
+			status(verb, p)
+		}
+		for _, k := range resp.Failed {
+			fmt.Println("kept", k)
+		}
+		if len(resp.Names) == 0 && len(resp.Failed) == 0 {
+			status("nothing to clean up")
+		}
+
+	case "inspect":
+		if len(args) != 1 {
+			fmt.Println("Usage:", binaryName, "inspect <alias>[:<path>]")
+			os.Exit(1)
+		}
+		resp := SendCmd(Command{Type: "inspect", Name: ResolveMountName(args[0])})
+		if resp.Error != "" {
+			fmt.Println("Error:", resp.Error)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(resp.Mount, "", "  ")
+		fmt.Println(string(out))
+
+	case "shutdown", "restart-daemon":
+		resp := SendCmd(Command{Type: cmd})
+		if resp.Error != "" {
+			fmt.Println("Error:", resp.Error)
+			os.Exit(1)
+		}
+		for _, n := range resp.Names {
+			status(n, "stopped")
+		}
+		if cmd == "shutdown" {
+			status("daemon stopped")
+		} else {
+			status("daemon restarted")
+		}
+
 	default:
 		PrintUsage()
 		os.Exit(1)
 	}
 }
 
+// upRun holds the up flags that change how the CLI goes about it rather
+// than the mount itself.
+type upRun struct {
+	dryRun, foreground, wait bool
+	waitTimeout              time.Duration
+
+	// file lists targets to mount together, see -f; batchFlags are the
+	// other flags given with it, which apply to each.
+	file       string
+	batchFlags []string
+}
+
+// parseUp parses the arguments of up: flags, then the target and an
+// optional mountpoint.
+func parseUp(args []string) (Command, upRun, error) {
+	var run upRun
+	flags := flag.NewFlagSet("up", flag.ExitOnError)
+	initialBackoff := flags.Duration("initial-backoff", 0, "first reconnect delay, doubled per attempt (default 2s)")
+	maxBackoff := flags.Duration("max-backoff", 0, "upper bound for the reconnect delay (default 10s)")
+	waitForNetwork := flags.Bool("wait-for-network", false, "wait until the host is reachable before connecting")
+	networkTimeout := flags.Duration("network-timeout", time.Minute, "how long --wait-for-network waits")
+	flags.BoolVar(&run.wait, "wait", false, "return only once the mount answers requests")
+	flags.DurationVar(&run.waitTimeout, "wait-timeout", 30*time.Second, "how long --wait waits")
+	limit := flags.Int64("limit", 0, "cap mount throughput in bytes/s (0 = unlimited)")
+	flags.BoolVar(&run.dryRun, "dry-run", false, "print the resolved host, remote root, mountpoint and mount command, then exit")
+	flags.BoolVar(&run.foreground, "foreground", false, "serve the mount from this process until SIGINT/SIGTERM")
+	flags.StringVar(&run.file, "f", "", "mount every target listed in this file, - for stdin, one per line as <alias>[:<path>] [mountpoint] [flags]; flags given here apply to all")
+	name := flags.String("name", "", "friendly mount name to use instead of alias:path")
+	bind := flags.String("bind", "127.0.0.1", "address the NFS server listens on")
+	sftpServer := flags.String("sftp-server", "", "SFTP subsystem name, or path of an sftp-server to run, when the server lacks the standard subsystem (like sftp -s)")
+	backgroundKeepalive := flags.Bool("background-keepalive", false, "reconnect as soon as a keepalive fails, not on the next file operation")
+	connectTimeout := flags.Duration("connect-timeout", ssh.DefaultConnectTimeout, "give up connecting to the host, TCP and SSH handshake, after this long")
+	var sshfsOpts sshfsOptions
+	flags.Var(&sshfsOpts, "o", "sshfs-style options, comma-separated: reconnect, ServerAliveInterval=N, ServerAliveCountMax=N, ConnectTimeout=N (seconds)")
+	force := flags.Bool("force", false, "mount over a non-empty mountpoint, hiding its contents until unmounted")
+	into := flags.Bool("into", false, "mount in a new subdirectory of the given mountpoint, named after the mount")
+	prewarm := flags.Int("prewarm", 0, "on mount, cache the listings of up to this many entries of the tree from one remote find (GNU find; 0 = off)")
+	noCache := flags.Bool("no-cache", false, "do not cache listings or attributes; every lookup asks the server")
+	readCacheSize := flags.Int64("read-cache-size", 0, "keep up to this many bytes of file content read through the mount on local disk (0 = no disk cache)")
+	replace := flags.Bool("replace", false, "replace a running mount of the same name, keeping the mountpoint attached when only server-side options change")
+	port := flags.String("port", "", "port the NFS server listens on (default a free one)")
+	export := flags.Bool("export", false, "serve NFS for other hosts instead of mounting locally")
+	key := flags.String("key", "", "offer only this private key, skipping ssh config keys and the agent")
+	identitiesOnly := flags.Bool("identities-only", false, "offer only the ssh config's IdentityFile keys, not every key in the agent, like IdentitiesOnly yes (default from the ssh config)")
+	frontend := flags.String("frontend", "nfs", "protocol to serve: nfs, or webdav for other hosts' WebDAV clients, e.g. Windows (implies --export; rfs itself still runs on a Unix host)")
+	passwordFile := flags.String("password-file", filepath.Join(stateDir, "webdav.password"), "file holding the password WebDAV clients log in with as user "+rfsmount.DAVUser+", created if missing")
+	authMode := flags.String("auth", "sys", "NFS credential check: sys (only your uid) or null (anyone)")
+	mountBase := flags.String("base", os.Getenv("RFS_MOUNT_BASE"), "parent directory for auto-created mountpoints (default $RFS_MOUNT_BASE or "+filepath.Join(stateDir, "mnt")+")")
+	mountTemplate := flags.String("mountpoint-template", os.Getenv("RFS_MOUNTPOINT_TEMPLATE"), "derive the mountpoint from {alias}, {path} and {name}, e.g. ~/mnt/{alias}/{path} (default $RFS_MOUNTPOINT_TEMPLATE)")
+	cwdFromShell := flags.Bool("cwd-from-shell", false, "for ~ or no path, mount where a login shell starts instead of the SFTP home")
+	pre := flags.String("pre", "", "remote command to run over the mount's SSH connection before mounting, e.g. \"mkdir -p /data/new\"; the mount fails if it does")
+	verify := flags.Bool("verify", true, "check that the remote path exists and is a directory before mounting")
+	idleTimeout := flags.Duration("idle-timeout", 0, "unmount after this long without file activity (0 = never)")
+	opTimeout := flags.Duration("op-timeout", ssh.DefaultOpTimeout, "give up on an SFTP request after this long and reconnect, for servers that stall without dropping the connection (0 = never)")
+	adjustMtime := flags.Bool("adjust-mtime", false, "correct reported file times by the server's clock skew, measured at mount time, so make and rsync compare them with local times correctly")
+	symlinks := flags.String("symlinks", "raw", "absolute symlink targets: raw (as on the server), relative (rewrite those inside the mount) or contain (also refuse links leaving it)")
+	rsize := flags.Int("rsize", 0, fmt.Sprintf("largest NFS read in bytes, for both the mount and the server (default %d)", ssh.DefaultIOSize))
+	wsize := flags.Int("wsize", 0, fmt.Sprintf("largest NFS write in bytes, for both the mount and the server (default %d)", ssh.DefaultIOSize))
+	readOnly := flags.Bool("read-only", false, "refuse every change to the remote tree (default on when mounting the server's root, alias:/)")
+	followSymlinks := flags.Bool("follow-symlinks", false, "present remote symlinks as the files and directories they point at")
+	exactLinks := flags.Bool("exact-nlink", false, "list directories that are not cached to count their subdirectories in the link count, for tools that trust nlink (default reports 1, unknown)")
+	effectivePerms := flags.Bool("effective-perms", false, "show what the SSH user may do with each file in its owner permission bits, so local access checks match the server")
+	ignore := flags.String("ignore", "", "comma-separated globs (e.g. node_modules,.git) hidden from the mount")
+	logMode := flags.String("log-mode", "rotate", "when the log is full: rotate, truncate, or off to not log at all")
+	logFiles := flags.Int("log-files", 1, "rotated log files to keep with --log-mode rotate")
+	maxLogSize := flags.Int64("max-log-size", 10*1024*1024, "log size in bytes that triggers rotation or truncation")
+	logLevel := flags.String("log-level", os.Getenv("RFS_LOG_LEVEL"), "debug, info, warn or error (default $RFS_LOG_LEVEL or info)")
+	flags.Parse(args)
+	args = flags.Args()
+
+	if run.file != "" {
+		if len(args) > 0 {
+			return Command{}, run, fmt.Errorf("-f takes its targets from the file, not the command line")
+		}
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name != "f" {
+				run.batchFlags = append(run.batchFlags, "--"+f.Name+"="+f.Value.String())
+			}
+		})
+		return Command{}, run, nil
+	}
+	if (len(args) < 1) || (len(args) > 2) {
+		fmt.Println("Usage:", binaryName, "up [flags] <alias>[:<path>] [mountpoint] | up [flags] -f <file>")
+		fmt.Println("<alias> may also be [user@]host; give a port as host:port:<path>, or host:port: for the home directory")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	configAlias, targetPath := ParseTarget(args[0])
+	if err := applyConfigDefaults(flags, configAlias); err != nil {
+		return Command{}, run, err
+	}
+	if targetPath == "/" {
+		// The whole server is for browsing: keep it read-only, and
+		// resolve absolute links inside the mount rather than
+		// against the local filesystem, unless told otherwise.
+		set := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["read-only"] {
+			*readOnly = true
+		}
+		if !set["symlinks"] {
+			*symlinks = ssh.SymlinksRelative
+		}
+	}
+	switch *frontend {
+	case "nfs":
+	case "webdav":
+		*export = true
+	default:
+		return Command{}, run, fmt.Errorf("--frontend must be nfs or webdav")
+	}
+	if ip := net.ParseIP(*bind); (ip == nil || !ip.IsLoopback()) && !*export {
+		return Command{}, run, fmt.Errorf("--bind to a non-loopback address requires --export")
+	}
+	if n, err := strconv.Atoi(*port); *port != "" && (err != nil || n < 1 || n > 65535) {
+		return Command{}, run, fmt.Errorf("--port must be a number between 1 and 65535")
+	}
+	for _, size := range []struct {
+		flag  string
+		value int
+	}{{"rsize", *rsize}, {"wsize", *wsize}} {
+		if size.value != 0 && (size.value < 4096 || size.value > 1024*1024 || size.value%4096 != 0) {
+			return Command{}, run, fmt.Errorf("--%s must be a multiple of 4096 between 4096 and 1048576", size.flag)
+		}
+	}
+	if *connectTimeout <= 0 {
+		return Command{}, run, fmt.Errorf("--connect-timeout must be positive")
+	}
+	if sshfsOpts.connectTimeout > 0 {
+		explicit := false
+		flags.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "connect-timeout" })
+		if !explicit {
+			*connectTimeout = sshfsOpts.connectTimeout
+		}
+	}
+	if *into && len(args) != 2 {
+		return Command{}, run, fmt.Errorf("--into needs a mountpoint")
+	}
+	if *export && len(args) == 2 {
+		return Command{}, run, fmt.Errorf("--export does not take a mountpoint")
+	}
+	if strings.ContainsAny(*name, "/") {
+		return Command{}, run, fmt.Errorf("--name must not contain '/'")
+	}
+	var ignorePatterns []string
+	for _, p := range strings.Split(*ignore, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ignorePatterns = append(ignorePatterns, p)
+		}
+	}
+	if *logLevel != "" {
+		if _, err := ssh.ParseLogLevel(*logLevel); err != nil {
+			return Command{}, run, fmt.Errorf("--log-level: %w", err)
+		}
+	}
+	alias, path := ParseTarget(args[0])
+	mountDir := ""
+	if len(args) == 2 {
+		mountDir = args[1]
+	}
+	if *mountBase != "" {
+		*mountBase = expandHome(*mountBase)
+	}
+	if mountDir != "" {
+		mountDir = expandHome(mountDir)
+	}
+	if *mountTemplate != "" {
+		*mountTemplate, _ = filepath.Abs(expandHome(*mountTemplate))
+	}
+	if *key != "" {
+		*key, _ = filepath.Abs(expandHome(*key))
+	}
+	if *frontend == "webdav" {
+		*passwordFile = expandHome(*passwordFile)
+	} else {
+		*passwordFile = ""
+	}
+	var waitFor time.Duration
+	if *waitForNetwork {
+		waitFor = *networkTimeout
+	}
+	upCmd := Command{
+		Type:           "up",
+		Name:           *name,
+		SSHAlias:       alias,
+		RemotePath:     path,
+		MountDir:       mountDir,
+		MountBase:      *mountBase,
+		MountTemplate:  *mountTemplate,
+		InitialBackoff: *initialBackoff,
+		MaxBackoff:     *maxBackoff,
+		WaitForNetwork: waitFor,
+		Limit:          *limit,
+		Bind:           *bind,
+		Port:           *port,
+		Export:         *export,
+		Frontend:       *frontend,
+		PasswordFile:   *passwordFile,
+		Auth:           *authMode,
+		CwdFromShell:   *cwdFromShell,
+		Pre:            *pre,
+		LogLevel:       *logLevel,
+		Ignore:         ignorePatterns,
+		NoVerify:       !*verify,
+		FollowSymlinks: *followSymlinks,
+		EffectivePerms: *effectivePerms,
+		ExactLinks:     *exactLinks,
+		Replace:        *replace,
+		IdleTimeout:    *idleTimeout,
+		OpTimeout:      *opTimeout,
+		AdjustMtime:    *adjustMtime,
+		Symlinks:       *symlinks,
+		IdentityFile:   *key,
+		IdentitiesOnly: *identitiesOnly,
+		SFTPServer:     *sftpServer,
+		ReadCacheSize:  *readCacheSize,
+		NoCache:        *noCache,
+		Force:          *force,
+		Into:           *into,
+		LogMode:        *logMode,
+		LogFiles:       *logFiles,
+		MaxLogSize:     *maxLogSize,
+		Prewarm:        *prewarm,
+		ReadOnly:       *readOnly,
+		RSize:          *rsize,
+		WSize:          *wsize,
+
+		BackgroundKeepalive: *backgroundKeepalive,
+		KeepaliveInterval:   sshfsOpts.keepaliveInterval,
+		KeepaliveCountMax:   sshfsOpts.keepaliveCountMax,
+		ConnectTimeout:      *connectTimeout,
+	}
+	return upCmd, run, nil
+}
+
+// expandHome resolves a leading ~ and makes p absolute, since the daemon
+// may run with a different working directory.
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		home, _ := os.UserHomeDir()
+		p = filepath.Join(home, p[1:])
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return abs
+}
+
+// waitUsable polls until m serves requests: its mountpoint is mounted and
+// the root can be listed, or for an export, the server takes connections.
+func waitUsable(m *MountInfo, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !usable(m) {
+		if time.Now().After(deadline) {
+			if m.Export {
+				return fmt.Errorf("%s not accepting connections after %v", m.Address, timeout)
+			}
+			return fmt.Errorf("%s not usable after %v", m.MountDir, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+func usable(m *MountInfo) bool {
+	if m.Export {
+		conn, err := net.DialTimeout("tcp", m.Address, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	if !rfsmount.IsMounted(m.MountDir) {
+		return false
+	}
+	// A mount that is not answering yet can block the listing, so give up
+	// on it and try again rather than hang.
+	listed := make(chan error, 1)
+	go func() {
+		_, err := os.ReadDir(m.MountDir)
+		listed <- err
+	}()
+	select {
+	case err := <-listed:
+		return err == nil
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+func printMount(m *MountInfo) {
+	if quiet {
+		return
+	}
+	if m.Frontend == "webdav" {
+		fmt.Printf("%s:%s  WebDAV on http://%s/ (Windows: net use Z: http://<host>:%s/ /user:%s, password in %s)\n", m.SSHAlias, m.RemotePath, m.Address, m.Port, rfsmount.DAVUser, m.PasswordFile)
+		return
+	}
+	if m.Export {
+		fmt.Printf("%s:%s  exported on %s (mount with: mount -t nfs -o nfsvers=4,tcp,port=%s <host>:/ <dir>)\n", m.SSHAlias, m.RemotePath, m.Address, m.Port)
+		return
+	}
+	fmt.Printf("%s:%s  port:%s  %s\n", m.SSHAlias, m.RemotePath, m.Port, m.MountDir)
+}
+
 func PrintUsage() {
-	fmt.Println("Usage:", binaryName, "<command>")
+	fmt.Println("Usage:", binaryName, "[--quiet | --verbose] <command>")
+	fmt.Println("")
+	fmt.Println("Global flags (before the command):")
+	fmt.Println("  --quiet                            Print only errors")
+	fmt.Println("  --verbose                          Print resolved ssh config and timings to stderr")
 	fmt.Println("")
 	fmt.Println("Commands:")
 	fmt.Println("  up <alias>[:<path>] [mountpoint]   Mount a remote directory")
-	fmt.Println("  ls                                 List all mounts")
+	fmt.Println("  up -f <file>                       Mount every target listed in a file (- for stdin) at once")
+	fmt.Println("  ls [--sort name|uptime|port]       List all mounts")
 	fmt.Println("  down <alias>[:<path>]              Stop a mount")
+	fmt.Println("  down --port <port> | --name <name> Stop a mount by port or exact name")
+	fmt.Println("  down --all                         Stop all mounts")
+	fmt.Println("  unmount <alias>[:<path>]           Stop a mount, always keeping its directory (same flags as down)")
 	fmt.Println("  logs <alias>[:<path>]              Show logs for a mount")
+	fmt.Println("  get <alias>[:<path>] <localdir>    Copy a remote directory without mounting")
+	fmt.Println("  open <alias>[:<path>]              Open a mount in the file manager")
+	fmt.Println("  exec <alias>[:<path>] -- <cmd>     Run a command over the mount's SSH connection")
+	fmt.Println("  hash <alias>:<path>                Print the SHA-256 of a remote file, computed on the server")
+	fmt.Println("  stats [<alias>[:<path>]...]        Show transfer and operation counters")
+	fmt.Println("  refresh <alias>[:<path>]           Drop a mount's cached listings and attributes")
+	fmt.Println("  reconnect <alias>[:<path>]         Reconnect a mount now, e.g. after resume or a VPN change")
+	fmt.Println("  inspect <alias>[:<path>]           Show everything known about a mount as JSON")
+	fmt.Println("  doctor [alias]                     Check the local setup for common problems")
+	fmt.Println("  gc [--dry-run]                     Remove state, logs and mountpoints left by mounts that died")
+	fmt.Println("  shutdown                           Stop all mounts and the daemon")
+	fmt.Println("  restart-daemon                     Stop all mounts and restart the daemon")
+	fmt.Println("")
+	fmt.Println("Environment:")
+	fmt.Println("  RFS_STATE_DIR                      State, socket and log directory (default ~/.rfs)")
+	fmt.Println("  RFS_MOUNT_BASE                     Parent of auto-created mountpoints (default $RFS_STATE_DIR/mnt)")
+	fmt.Println("  RFS_MOUNTPOINT_TEMPLATE            Mountpoint from {alias}, {path} and {name} when none is given")
+	fmt.Println("  RFS_IDENTITY_AGENTS                Extra agent sockets, separated like $PATH, whose keys are also offered")
+	fmt.Println("  RFS_PORT_RANGE                     Ports lo-hi the daemon picks NFS server ports from")
+	fmt.Println("  RFS_PROBE_INTERVAL                 How often the daemon checks its mounts (default 5s)")
+	fmt.Println("  RFS_PROBE_GRACE                    How long a new mount has to come up before it is checked (default 10s)")
+	fmt.Println("  RFS_DAEMON                         Control the daemon at tcp://host:port (started with daemon --listen)")
+	fmt.Println("  RFS_TOKEN                          Token for RFS_DAEMON, from the daemon's --token-file")
+	fmt.Println("  RFS_LOG_LEVEL                      Log verbosity: debug, info, warn or error (default info)")
+	fmt.Println("")
+	fmt.Println("Per-alias defaults for up flags are read from", configPath())
 }
 
+// ParseTarget splits alias[:path]. The alias may also be a direct
+// [user@]host target, and a port is given only as host:port:path, with an
+// empty path for the home directory (host:2222:). A lone numeric segment
+// stays a path, so alias:2024 is still the directory 2024.
 func ParseTarget(target string) (alias, path string) {
-	target = strings.TrimRight(target, "/")
-	for i := 0; i < len(target); i++ {
-		if target[i] == ':' {
-			return target[:i], target[i+1:]
+	start := 0
+	if at, colon := strings.Index(target, "@"), strings.Index(target, ":"); at >= 0 && (colon < 0 || at < colon) {
+		start = at + 1
+	}
+	if strings.HasPrefix(target[start:], "[") {
+		if end := strings.Index(target[start:], "]"); end >= 0 {
+			start += end
+		}
+	}
+	i := strings.Index(target[start:], ":")
+	if i < 0 {
+		return strings.TrimRight(target, "/"), "~"
+	}
+	alias, path = target[:start+i], target[start+i+1:]
+
+	if port, rest, ok := strings.Cut(path, ":"); ok && port != "" && strings.Trim(port, "0123456789") == "" {
+		alias += ":" + port
+		if rest == "" {
+			return alias, "~"
 		}
+		path = rest
 	}
-	return target, "~"
+	// Trailing slashes go, but a path of nothing else is the root.
+	if trimmed := strings.TrimRight(path, "/"); trimmed != "" || path == "" {
+		return alias, trimmed
+	}
+	return alias, "/"
 }
 
 func MountName(alias, path string) string {
-	if path == "" || path == "/" {
+	if path == "" {
 		return alias
 	}
+	if path == "/" {
+		return alias + ":"
+	}
 	if path == "~" {
 		return alias + ":~"
 	}
@@ -209,7 +981,41 @@ func MountName(alias, path string) string {
 	return alias + ":" + safePath
 }
 
+// ResolveMountName maps a user-supplied target to a mount name. The target
+// may be a friendly name given with `up --name` or the alias[:path] form;
+// the latter is matched against the recorded mounts so it still finds a
+// mount that was renamed.
 func ResolveMountName(target string) string {
+	states := readStates()
+	for _, info := range states {
+		if info.Name == target {
+			return target
+		}
+	}
 	alias, path := ParseTarget(target)
-	return MountName(alias, path)
+	name := MountName(alias, path)
+	for _, info := range states {
+		if MountName(info.SSHAlias, info.RemotePath) == name {
+			return info.Name
+		}
+	}
+	return name
+}
+
+// readStates loads the MountInfo of every mount the daemon has recorded.
+func readStates() []*MountInfo {
+	paths, _ := filepath.Glob(filepath.Join(stateDir, "tmp", "*.state"))
+	var states []*MountInfo
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var info MountInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		states = append(states, &info)
+	}
+	return states
 }
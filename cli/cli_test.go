@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target, alias, path string
+	}{
+		{"alias", "alias", "~"},
+		{"alias/", "alias", "~"},
+		{"alias:", "alias", ""},
+		{"alias:/", "alias", "/"},
+		{"alias:/srv/data/", "alias", "/srv/data"},
+		{"alias:src", "alias", "src"},
+		{"alias:2024", "alias", "2024"},
+		{"alias:2024/notes", "alias", "2024/notes"},
+		{"host:2222:", "host:2222", "~"},
+		{"host:2222:/srv", "host:2222", "/srv"},
+		{"user@host:2222:src", "user@host:2222", "src"},
+		{"user@host:/srv", "user@host", "/srv"},
+		{"[2001:db8::1]", "[2001:db8::1]", "~"},
+		{"[2001:db8::1]:/srv", "[2001:db8::1]", "/srv"},
+		{"user@[2001:db8::1]:2222:/srv", "user@[2001:db8::1]:2222", "/srv"},
+		{"[2001:db8::1]:2024", "[2001:db8::1]", "2024"},
+	}
+	for _, tt := range tests {
+		alias, path := ParseTarget(tt.target)
+		if alias != tt.alias || path != tt.path {
+			t.Errorf("ParseTarget(%q) = %q, %q; want %q, %q", tt.target, alias, path, tt.alias, tt.path)
+		}
+	}
+}
+
+func TestMountName(t *testing.T) {
+	tests := []struct {
+		alias, path, want string
+	}{
+		{"alias", "", "alias"},
+		{"alias", "/", "alias:"},
+		{"alias", "~", "alias:~"},
+		{"alias", "/srv/data", "alias:srv:data"},
+		{"alias", "src/app", "alias:src:app"},
+		{"host:2222", "/srv", "host:2222:srv"},
+	}
+	for _, tt := range tests {
+		if got := MountName(tt.alias, tt.path); got != tt.want {
+			t.Errorf("MountName(%q, %q) = %q, want %q", tt.alias, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffSchedule(t *testing.T) {
+	tests := []struct {
+		initial, max time.Duration
+		want         string
+	}{
+		{2 * time.Second, 10 * time.Second, "2s-10s"},
+		{500 * time.Millisecond, time.Minute, "500ms-1m0s"},
+		{0, 0, "-"},
+	}
+	for _, tt := range tests {
+		m := &MountInfo{InitialBackoff: tt.initial, MaxBackoff: tt.max}
+		if got := backoffSchedule(m); got != tt.want {
+			t.Errorf("backoffSchedule(%v, %v) = %q, want %q", tt.initial, tt.max, got, tt.want)
+		}
+	}
+}
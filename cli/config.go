@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// config holds per-alias defaults for up, read from configPath. Each alias
+// maps up's flag names to values, e.g.
+//
+//	{"aliases": {"web1": {"ignore": "node_modules,.git", "idle-timeout": "1h"}}}
+//
+// The "*" alias applies to every host.
+type config struct {
+	Aliases map[string]map[string]any `json:"aliases"`
+}
+
+func configPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "rfs", "config.json")
+}
+
+func loadConfig() (*config, error) {
+	data, err := os.ReadFile(configPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath(), err)
+	}
+	return &c, nil
+}
+
+// applyConfigDefaults sets every flag not given on the command line from
+// the alias's entry, then from "*", so command-line flags always win.
+func applyConfigDefaults(flags *flag.FlagSet, alias string) error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, key := range []string{alias, "*"} {
+		for name, value := range c.Aliases[key] {
+			if set[name] {
+				continue
+			}
+			if flags.Lookup(name) == nil {
+				return fmt.Errorf("%s: %s: unknown option %q", configPath(), key, name)
+			}
+			if err := flags.Set(name, configValue(value)); err != nil {
+				return fmt.Errorf("%s: %s: %s: %w", configPath(), key, name, err)
+			}
+			set[name] = true
+		}
+	}
+	return nil
+}
+
+// configValue renders a JSON value as a flag argument. Lists become comma
+// separated, as --ignore expects.
+func configValue(v any) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = configValue(e)
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(v)
+}
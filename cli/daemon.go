@@ -2,24 +2,24 @@ package cli
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	rfsmount "rfs/mount"
 	"rfs/ssh"
 
-	"github.com/smallfz/libnfs-go/auth"
-	"github.com/smallfz/libnfs-go/backend"
-	nfsFs "github.com/smallfz/libnfs-go/fs"
 	nfsLog "github.com/smallfz/libnfs-go/log"
-	"github.com/smallfz/libnfs-go/server"
 )
 
 type nfsFileHandler struct {
@@ -32,44 +32,129 @@ func (h *nfsFileHandler) Write(msg *nfsLog.Message) {
 }
 
 func newNFSLogger(file *os.File) nfsLog.Logger {
-	return nfsLog.NewLogger("nfs", nfsLog.INFO, &nfsFileHandler{file})
+	return nfsLog.NewLogger("nfs", nfsLevel(ssh.GetLogLevel()), &nfsFileHandler{file})
+}
+
+func nfsLevel(l ssh.LogLevel) int {
+	switch l {
+	case ssh.LevelDebug:
+		return nfsLog.DEBUG
+	case ssh.LevelWarn:
+		return nfsLog.WARNING
+	case ssh.LevelError:
+		return nfsLog.ERROR
+	}
+	return nfsLog.INFO
+}
+
+// initLogLevel applies $RFS_LOG_LEVEL, the daemon-wide default that
+// up --log-level overrides.
+func initLogLevel() {
+	if env := os.Getenv("RFS_LOG_LEVEL"); env != "" {
+		if level, err := ssh.ParseLogLevel(env); err == nil {
+			ssh.SetLogLevel(level)
+		}
+	}
 }
 
 type mount struct {
 	info      *MountInfo
-	logFile   io.Closer
-	sshFS     *ssh.SSHFS
-	client    *ssh.SSHClient
+	logFile   *rotatingFile
+	mnt       *rfsmount.Mount
+	done      chan struct{} // closed once the mount has been torn down
 	mu        sync.Mutex
 	stopped   bool
 	createdAt time.Time
+	health    *health
+	rates     throughput
+
+	// createdDir is set when the mountpoint was made for this mount, and
+	// so is removed with it.
+	createdDir bool
 }
 
 type Daemon struct {
 	socketPath string
 	mounts     map[string]*mount
 	mu         sync.Mutex
+
+	// tcpAddr and token are set by Configure for remote control.
+	tcpAddr string
+	token   string
+	args    []string // the daemon's own arguments, kept across reexec
+
+	// portMin and portMax bound the ports picked for NFS servers, see
+	// --local-port-range; zero means any free port.
+	portMin, portMax int
+
+	// starting holds the addresses handed to mounts still starting up,
+	// whose servers do not listen yet, see reservePort.
+	starting map[string]bool
+
+	// startingDirs likewise holds the mountpoints picked for them, see
+	// freeMountDir.
+	startingDirs map[string]bool
+
+	// probeInterval is how often the monitor checks every mount, and
+	// probeGrace how long a new mount is left alone to come up, see
+	// --probe-interval and --probe-grace.
+	probeInterval, probeGrace time.Duration
 }
 
+const (
+	defaultProbeInterval = 5 * time.Second
+	defaultProbeGrace    = 10 * time.Second
+)
+
 func NewDaemon() *Daemon {
 	return &Daemon{
-		socketPath: filepath.Join(StateDir(), "daemon.sock"),
-		mounts:     make(map[string]*mount),
+		socketPath:    filepath.Join(StateDir(), "daemon.sock"),
+		mounts:        make(map[string]*mount),
+		starting:      make(map[string]bool),
+		startingDirs:  make(map[string]bool),
+		probeInterval: defaultProbeInterval,
+		probeGrace:    defaultProbeGrace,
 	}
 }
 
 const maxLogSize = 10 * 1024 * 1024 // 10MB
 
-func (d *Daemon) openLogFile(name string) (*truncatingFile, error) {
+// openLogFile starts a fresh log for mount name, honouring the log options
+// of cmd: LogMode "rotate" (the default) keeps LogFiles old files as
+// <name>.log.1 and up, "truncate" empties the log when full, and "off"
+// discards everything.
+func (d *Daemon) openLogFile(name string, cmd Command) (*rotatingFile, error) {
 	logPath := filepath.Join(StateDir(), "tmp", name+".log")
 
 	os.Remove(logPath)
+	old, _ := filepath.Glob(logPath + ".*")
+	for _, p := range old {
+		os.Remove(p)
+	}
+
+	maxSize := cmd.MaxLogSize
+	if maxSize <= 0 {
+		maxSize = maxLogSize
+	}
+	keep := cmd.LogFiles
+	if keep <= 0 {
+		keep = 1
+	}
+	switch cmd.LogMode {
+	case "", "rotate":
+	case "truncate":
+		keep = 0
+	case "off":
+		return &rotatingFile{path: logPath}, nil
+	default:
+		return nil, fmt.Errorf("unknown log mode %q (want rotate, truncate or off)", cmd.LogMode)
+	}
 
-	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
-	return &truncatingFile{File: f, maxSize: maxLogSize}, nil
+	return &rotatingFile{path: logPath, file: f, maxSize: maxSize, keep: keep}, nil
 }
 func (d *Daemon) ensureDirs() error {
 	mountsDir := filepath.Join(StateDir(), "tmp")
@@ -84,7 +169,7 @@ func (d *Daemon) cleanupOldLogs() {
 	today := time.Now().Format("2006-01-02")
 	entries, _ := os.ReadDir(mountsDir)
 	for _, e := range entries {
-		if !strings.HasSuffix(e.Name(), ".log") {
+		if !strings.HasSuffix(e.Name(), ".log") && !strings.Contains(e.Name(), ".log.") {
 			continue
 		}
 		path := filepath.Join(mountsDir, e.Name())
@@ -99,74 +184,118 @@ func (d *Daemon) cleanupOldLogs() {
 	}
 }
 
-func (d *Daemon) cleanupStaleState() {
-	mountsDir := filepath.Join(StateDir(), "tmp")
-	entries, err := os.ReadDir(mountsDir)
-	if err != nil {
-		return
-	}
-	for _, e := range entries {
-		if !strings.HasSuffix(e.Name(), ".state") {
-			continue
-		}
-	}
-}
-
-type truncatingFile struct {
-	*os.File
+// rotatingFile is a log file capped at maxSize. When a write would exceed
+// the cap, older files shift up (<name>.1 becomes <name>.2 and so on, up
+// to keep), the file is renamed to <name>.1 and a fresh one is started, so
+// readers always see complete files. With keep 0 the file is emptied
+// instead; with no file at all, writes are discarded.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
 	maxSize int64
+	keep    int
 }
 
-func (f *truncatingFile) Write(p []byte) (int, error) {
-	if info, err := f.Stat(); err == nil && info.Size() >= f.maxSize {
-		content, err := os.ReadFile(f.Name())
-		if err != nil {
-			return 0, err
-		}
-
-		newContent := content[len(content)/2:]
-		if err := os.WriteFile(f.Name(), newContent, 0644); err != nil {
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return len(p), nil
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
 			return 0, err
 		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
 
-		f.File.Close()
-		newFile, err := os.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
-			return 0, err
-		}
-		*f.File = *newFile
+func (f *rotatingFile) rotate() error {
+	if f.keep == 0 {
+		f.size = 0
+		return f.file.Truncate(0)
 	}
-	_, err := f.Seek(0, 2)
+	f.file.Close()
+	for i := f.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return f.File.Write(p)
+	f.file = file
+	f.size = 0
+	return nil
 }
 
-func (f *truncatingFile) Close() error {
-	return f.File.Close()
+func (f *rotatingFile) Name() string {
+	return f.path
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
 }
 
 func (d *Daemon) Start() error {
+	initLogLevel()
 	if err := d.ensureDirs(); err != nil {
-		return err
+		return fmt.Errorf("cannot create %s: %w", StateDir(), err)
 	}
 
+	lock, err := d.acquireLock()
+	if err != nil {
+		if errors.Is(err, errDaemonRunning) {
+			return fmt.Errorf("%w (pid file %s)", err, filepath.Join(StateDir(), "daemon.pid"))
+		}
+		return fmt.Errorf("lock %s: %w", filepath.Join(StateDir(), "daemon.pid"), err)
+	}
+	defer lock.Close()
+
 	d.cleanupStaleState()
 	d.cleanupOldLogs()
 
 	if err := os.RemoveAll(d.socketPath); err != nil {
-		return err
+		return fmt.Errorf("remove stale socket: %w", err)
 	}
 
+	// Whoever can connect can run commands on every remote host as our
+	// SSH identity, so the socket is ours alone from the moment it
+	// exists.
+	oldMask := syscall.Umask(0077)
 	ln, err := net.Listen("unix", d.socketPath)
+	syscall.Umask(oldMask)
 	if err != nil {
-		return err
+		return fmt.Errorf("listen on %s: %w", d.socketPath, err)
 	}
 	defer ln.Close()
 
-	os.Chmod(d.socketPath, 0777)
+	if err := os.Chmod(d.socketPath, 0600); err != nil {
+		return fmt.Errorf("chmod %s: %w", d.socketPath, err)
+	}
+
+	if d.tcpAddr != "" {
+		tl, err := net.Listen("tcp", d.tcpAddr)
+		if err != nil {
+			return fmt.Errorf("listen on %s: %w", d.tcpAddr, err)
+		}
+		defer tl.Close()
+		ssh.Infof("accepting authenticated commands on tcp://%s", tl.Addr())
+		go d.serveTCP(tl)
+	}
 
+	go d.teardownOnSignal(ln)
 	go d.monitorMounts()
 
 	for {
@@ -174,11 +303,99 @@ func (d *Daemon) Start() error {
 		if err != nil {
 			continue
 		}
-		go d.handleConn(conn)
+		go d.handleConn(conn, false)
 	}
 }
 
-func (d *Daemon) handleConn(conn net.Conn) {
+var errDaemonRunning = errors.New("another daemon is already running")
+
+// acquireLock takes an exclusive flock on stateDir/daemon.pid and records
+// our PID in it. The kernel drops the lock when the process dies, so a lock
+// left by a crashed daemon is simply reacquired.
+func (d *Daemon) acquireLock() (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(StateDir(), "daemon.pid"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errDaemonRunning
+		}
+		return nil, err
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return f, nil
+}
+
+// teardownOnSignal unmounts everything and exits when the daemon is told
+// to stop (logout, shutdown, kill), so no mount is left pointing at a dead
+// NFS server.
+func (d *Daemon) teardownOnSignal(ln net.Listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-sigs
+	ssh.Infof("received %v, unmounting", sig)
+	d.handleStop(Command{All: true})
+	ln.Close()
+	os.Exit(0)
+}
+
+// RunForeground mounts cmd's target from the calling process, bypassing the
+// daemon socket, and blocks until SIGINT/SIGTERM or until the mount dies,
+// tearing it down the same way handleStop does.
+func RunForeground(cmd Command) error {
+	d := NewDaemon()
+	if err := d.ensureDirs(); err != nil {
+		return err
+	}
+	initLogLevel()
+	var err error
+	if d.portMin, d.portMax, err = parsePortRange(os.Getenv("RFS_PORT_RANGE")); err != nil {
+		return fmt.Errorf("RFS_PORT_RANGE: %w", err)
+	}
+	if d.probeInterval, err = envDuration("RFS_PROBE_INTERVAL", d.probeInterval); err != nil {
+		return err
+	}
+	if d.probeGrace, err = envDuration("RFS_PROBE_GRACE", d.probeGrace); err != nil {
+		return err
+	}
+
+	resp := d.handleUp(cmd)
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	printMount(resp.Mount)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	go d.monitorMounts()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-sigs:
+			ssh.Infof("received %v, unmounting", sig)
+			d.handleStop(Command{All: true})
+			return nil
+		case <-ticker.C:
+			d.mu.Lock()
+			hasMounts := len(d.mounts) > 0
+			d.mu.Unlock()
+			if !hasMounts {
+				return fmt.Errorf("mount %s went away", resp.Mount.Name)
+			}
+		}
+	}
+}
+
+// handleConn serves one command. Commands from remote (TCP) clients must
+// carry the daemon's token.
+func (d *Daemon) handleConn(conn net.Conn, remote bool) {
 	defer conn.Close()
 
 	var cmd Command
@@ -186,21 +403,70 @@ func (d *Daemon) handleConn(conn net.Conn) {
 		json.NewEncoder(conn).Encode(Response{Error: err.Error()})
 		return
 	}
+	if remote && !d.authorized(cmd.Token) {
+		ssh.Warnf("rejected unauthenticated %q command from %s", cmd.Type, conn.RemoteAddr())
+		json.NewEncoder(conn).Encode(Response{Error: "unauthorized"})
+		return
+	}
 
 	var resp Response
 	switch cmd.Type {
+	case "exec":
+		d.handleExec(conn, cmd)
+		d.exitIfIdle()
+		return
 	case "up":
-		resp = d.handleUp(cmd)
+		if len(cmd.Batch) > 0 {
+			resp = d.handleUpBatch(cmd.Batch)
+		} else {
+			resp = d.handleUp(cmd)
+		}
 	case "ls":
 		resp = d.handleList()
 	case "down":
-		resp = d.handleStop(cmd.Names)
+		resp = d.handleStop(cmd)
+	case "stats":
+		resp = d.handleStats(cmd.Names)
+	case "inspect":
+		resp = d.handleInspect(cmd.Name)
+	case "hash":
+		resp = d.handleHash(cmd)
+	case "refresh":
+		resp = d.handleRefresh(cmd.Name)
+	case "reconnect":
+		resp = d.handleReconnect(cmd.Name)
+	case "gc":
+		resp = d.handleGC(cmd)
+	case "shutdown", "restart-daemon":
+		resp = d.handleStop(Command{All: true})
 	default:
 		resp = Response{Error: "unknown command"}
 	}
 
 	json.NewEncoder(conn).Encode(resp)
 
+	switch cmd.Type {
+	case "shutdown":
+		ssh.Infof("shutdown requested")
+		os.Exit(0)
+	case "restart-daemon":
+		ssh.Infof("restart requested")
+		conn.Close()
+		if err := d.reexec(); err != nil {
+			ssh.Errorf("restart failed: %v", err)
+		}
+		os.Exit(1)
+	}
+
+	d.exitIfIdle()
+}
+
+// exitIfIdle stops the daemon once it has no mounts left to serve, unless
+// it listens for remote clients, which could not start it again.
+func (d *Daemon) exitIfIdle() {
+	if d.tcpAddr != "" {
+		return
+	}
 	d.mu.Lock()
 	hasMounts := len(d.mounts) > 0
 	d.mu.Unlock()
@@ -209,133 +475,430 @@ func (d *Daemon) handleConn(conn net.Conn) {
 	}
 }
 
+// reexec replaces the daemon process with a fresh copy of itself. The
+// listener and the lock file are close-on-exec, so the new image starts
+// from a clean slate.
+func (d *Daemon) reexec() error {
+	execPath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(execPath, append([]string{execPath, "daemon"}, d.args...), os.Environ())
+}
+
 func (d *Daemon) handleUp(cmd Command) Response {
-	alias := cmd.SSHAlias
-	remotePath := cmd.RemotePath
-	customMountDir := cmd.MountDir
-	name := MountName(alias, remotePath)
+	name := cmd.Name
+	if name == "" {
+		name = MountName(cmd.SSHAlias, cmd.RemotePath)
+	}
 
 	d.mu.Lock()
-	_, exists := d.mounts[name]
+	old, exists := d.mounts[name]
 	d.mu.Unlock()
-	if exists {
+	if exists && !cmd.Replace {
 		return Response{Error: "already mounted: " + name}
 	}
 
-	logFile, err := d.openLogFile(name)
+	var previous *MountInfo
+	swap := false
+	if exists {
+		info := *old.info
+		previous = &info
+		if swap = canSwap(old.info, cmd); swap {
+			// The new server takes over the old one's port, which the
+			// kernel mount keeps talking to; file handles encode paths,
+			// so they stay valid.
+			cmd.Port = old.info.Port
+			cmd.MountDir = old.info.MountDir
+			old.retire()
+			old.logFile.Close()
+		} else {
+			d.handleStop(Command{Names: []string{name}})
+		}
+	}
+
+	logFile, err := d.openLogFile(name, cmd)
 	if err != nil {
+		if swap {
+			d.abandon(name, old)
+		}
 		return Response{Error: "failed to create log: " + err.Error()}
 	}
 
-	m, err := d.startMount(alias, remotePath, name, customMountDir, logFile)
+	m, err := d.startMount(cmd, name, logFile, swap)
 	if err != nil {
 		logFile.Close()
+		if swap {
+			d.abandon(name, old)
+			return Response{Error: fmt.Sprintf("%v; the old mount was stopped", err)}
+		}
 		return Response{Error: err.Error()}
 	}
 
+	if swap {
+		m.createdDir = old.createdDir
+	}
 	d.mu.Lock()
 	m.createdAt = time.Now()
+	m.health = newHealth()
 	d.mounts[name] = m
 	d.mu.Unlock()
 
 	d.saveState(name, m.info)
+	go d.watchServer(name, m)
+	go sampleRates(m)
+	m.mnt.FS.SetOnReconnect(func() {
+		m.health.down()
+		m.health.up()
+		d.remountIfLost(m)
+	})
+
+	return Response{OK: true, Mount: m.info, Previous: previous}
+}
 
-	return Response{OK: true, Mount: m.info}
+// handleUpBatch brings up every command of an up -f at once, so their
+// connects and readiness waits overlap. Mounts come back in the order
+// given and failures as one line per target.
+func (d *Daemon) handleUpBatch(batch []Command) Response {
+	results := make([]Response, len(batch))
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i, cmd := range batch {
+		name := cmd.Name
+		if name == "" {
+			name = MountName(cmd.SSHAlias, cmd.RemotePath)
+		}
+		if seen[name] {
+			results[i] = Response{Error: "listed twice: " + name}
+			continue
+		}
+		seen[name] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = d.handleUp(cmd)
+		}()
+	}
+	wg.Wait()
+
+	resp := Response{OK: true}
+	for i, r := range results {
+		if r.Error != "" {
+			resp.Failed = append(resp.Failed, fmt.Sprintf("%s:%s: %s", batch[i].SSHAlias, batch[i].RemotePath, r.Error))
+			continue
+		}
+		resp.Mounts = append(resp.Mounts, r.Mount)
+	}
+	return resp
+}
+
+// canSwap reports whether cmd can replace the mount described by info
+// without unmounting: both serve the same tree over NFS to the same
+// mountpoint and port.
+func canSwap(info *MountInfo, cmd Command) bool {
+	if info.Export || cmd.Export || info.Frontend == "webdav" || cmd.Frontend == "webdav" {
+		return false
+	}
+	if cmd.SSHAlias != info.SSHAlias || cmd.RemotePath != info.RemotePath {
+		return false
+	}
+	if cmd.MountDir != "" && filepath.Clean(cmd.MountDir) != info.MountDir {
+		return false
+	}
+	if cmd.Port != "" && cmd.Port != info.Port {
+		return false
+	}
+	bind := cmd.Bind
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	host, _, _ := net.SplitHostPort(info.Address)
+	return host == bind && rfsmount.IsMounted(info.MountDir)
 }
 
-func (d *Daemon) startMount(alias, remotePath, name, customMountDir string, logFile *truncatingFile) (*mount, error) {
+// retire stops m's server and connections but leaves the kernel mount and
+// its log file alone, for a replacement to take over.
+func (m *mount) retire() {
+	m.mu.Lock()
+	if !m.stopped {
+		m.stopped = true
+		close(m.done)
+	}
+	m.mu.Unlock()
+	m.mnt.Close()
+}
+
+// abandon finishes off a retired mount whose replacement failed to start.
+func (d *Daemon) abandon(name string, old *mount) {
+	if err := rfsmount.Unmount(old.info.MountDir); err != nil {
+		ssh.Warnf("unmount %s: %v", old.info.MountDir, err)
+	}
+	d.mu.Lock()
+	if d.mounts[name] == old {
+		delete(d.mounts, name)
+	}
+	d.mu.Unlock()
+	d.deleteState(name)
+}
+
+// startMount connects and serves cmd. With attached, mountDir is already
+// mounted from a retired server on the same port, and is left as it is.
+func (d *Daemon) startMount(cmd Command, name string, logFile *rotatingFile, attached bool) (*mount, error) {
+	alias := cmd.SSHAlias
+	remotePath := cmd.RemotePath
+	customMountDir := cmd.MountDir
+
+	// removeMountDir undoes the mkdir below on failure. A directory that
+	// was already there is left alone: it may hold the user's files, or
+	// still be attached, and removing it would recurse into the remote
+	// tree.
+	created := false
+	removeMountDir := func(dir string) {
+		if created {
+			removeCreatedMountDir(dir)
+		}
+	}
+
 	log.SetOutput(logFile)
 
-	nfsLogger := nfsLog.NewLogger("nfs", nfsLog.INFO, &nfsFileHandler{logFile})
+	if cmd.LogLevel != "" {
+		if level, err := ssh.ParseLogLevel(cmd.LogLevel); err == nil {
+			ssh.SetLogLevel(level)
+		}
+	}
+	level := ssh.GetLogLevel()
+	nfsLogger := nfsLog.NewLogger("nfs", nfsLevel(level), &nfsFileHandler{logFile})
 	nfsLog.SetLoggerDefault(nfsLogger)
-	nfsLog.SetLevelName("info")
+	nfsLog.SetLevelName(level.String())
 
-	listen, err := findFreePort()
+	bind := cmd.Bind
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	listen, err := d.listenAddr(bind, cmd.Port)
 	if err != nil {
 		return nil, err
 	}
+	defer d.releasePort(listen)
+	_, port, _ := net.SplitHostPort(listen)
 
 	mountDir := customMountDir
-	if mountDir == "" {
-		mountDir = filepath.Join(StateDir(), "mnt", name)
+	if !cmd.Export {
+		switch {
+		case mountDir == "" && cmd.MountTemplate != "":
+			mountDir = d.freeMountDir(expandMountTemplate(cmd.MountTemplate, cmd, name))
+		case mountDir == "":
+			mountDir, err = d.autoMountDir(name, cmd.MountBase)
+		case cmd.Into:
+			mountDir, err = d.autoMountDir(name, mountDir)
+		case !attached && !cmd.Force && !rfsmount.IsMounted(mountDir) && !isEmptyDir(mountDir):
+			err = fmt.Errorf("mountpoint %s is not empty and mounting would hide its contents (use --force to mount over it, or --into to mount in a new subdirectory)", mountDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if customMountDir == "" || cmd.Into {
+			// Picked by freeMountDir, which reserved it.
+			defer d.releaseMountDir(mountDir)
+		}
+		if _, err := os.Stat(mountDir); os.IsNotExist(err) {
+			created = true
+		}
+		if err := os.MkdirAll(mountDir, 0755); err != nil {
+			return nil, err
+		}
 	}
-	if err := os.MkdirAll(mountDir, 0755); err != nil {
-		return nil, err
+
+	var davPassword string
+	if cmd.Frontend == "webdav" {
+		if cmd.PasswordFile == "" {
+			cmd.PasswordFile = filepath.Join(StateDir(), "webdav.password")
+		}
+		if davPassword, err = loadToken(cmd.PasswordFile); err != nil {
+			removeMountDir(mountDir)
+			return nil, fmt.Errorf("webdav password: %w", err)
+		}
 	}
 
-	client, err := ssh.Connect(alias)
+	mnt, err := rfsmount.Start(rfsmount.MountOptions{
+		Alias:      alias,
+		RemotePath: remotePath,
+		MountDir:   mountDir,
+		Listen:     listen,
+		Export:     cmd.Export,
+		Attached:   attached,
+		Frontend:   cmd.Frontend,
+		Auth:       cmd.Auth,
+
+		WebDAVPassword: davPassword,
+		SSH: ssh.Options{
+			InitialBackoff:      cmd.InitialBackoff,
+			MaxBackoff:          cmd.MaxBackoff,
+			IdentityFile:        cmd.IdentityFile,
+			IdentitiesOnly:      cmd.IdentitiesOnly,
+			SFTPServer:          cmd.SFTPServer,
+			BackgroundReconnect: cmd.BackgroundKeepalive,
+			KeepaliveInterval:   cmd.KeepaliveInterval,
+			KeepaliveCountMax:   cmd.KeepaliveCountMax,
+			ConnectTimeout:      cmd.ConnectTimeout,
+		},
+		WaitForNetwork: cmd.WaitForNetwork,
+		CwdFromShell:   cmd.CwdFromShell,
+		Pre:            cmd.Pre,
+		NoVerify:       cmd.NoVerify,
+		RateLimit:      cmd.Limit,
+		ReadOnly:       cmd.ReadOnly,
+		NoCache:        cmd.NoCache,
+		FollowSymlinks: cmd.FollowSymlinks,
+		EffectivePerms: cmd.EffectivePerms,
+		ExactLinks:     cmd.ExactLinks,
+		OpTimeout:      cmd.OpTimeout,
+		AdjustMtime:    cmd.AdjustMtime,
+		Symlinks:       cmd.Symlinks,
+		Ignore:         cmd.Ignore,
+		RSize:          cmd.RSize,
+		WSize:          cmd.WSize,
+		ReadCacheDir:   filepath.Join(StateDir(), "cache", name),
+		ReadCacheSize:  cmd.ReadCacheSize,
+		Prewarm:        cmd.Prewarm,
+		Log:            logFile,
+	})
 	if err != nil {
-		os.RemoveAll(mountDir)
-		return nil, fmt.Errorf("ssh connect: %w", err)
+		removeMountDir(mountDir)
+		return nil, err
 	}
 
-	session, err := client.NewSession()
-	if err != nil {
-		client.Close()
-		os.RemoveAll(mountDir)
-		return nil, fmt.Errorf("new session: %w", err)
+	m := &mount{
+		info: &MountInfo{
+			Name:     name,
+			PID:      os.Getpid(),
+			Port:     port,
+			Address:  listen,
+			Export:   cmd.Export,
+			Frontend: cmd.Frontend,
+			MountDir: mountDir,
+
+			PasswordFile: cmd.PasswordFile,
+			SSHAlias:     alias,
+			RemotePath:   remotePath,
+			StartedAt:    time.Now(),
+			LogFile:      logFile.Name(),
+
+			InitialBackoff: mnt.Client.Options().InitialBackoff,
+			MaxBackoff:     mnt.Client.Options().MaxBackoff,
+			IdleTimeout:    cmd.IdleTimeout,
+			ReadOnly:       cmd.ReadOnly,
+			RSize:          cmd.RSize,
+			WSize:          cmd.WSize,
+			AdjustMtime:    cmd.AdjustMtime,
+		},
+		logFile:    logFile,
+		mnt:        mnt,
+		createdDir: created,
+		done:       make(chan struct{}),
 	}
-	session.Stdout = logFile
-	session.Stderr = logFile
-	if err := session.Run("echo"); err != nil {
-		session.Close()
-		client.Close()
-		os.RemoveAll(mountDir)
-		return nil, fmt.Errorf("session run: %w", err)
+	if skew, ok := mnt.ClockSkew(); ok {
+		m.info.ClockSkew = skew.String()
 	}
-	session.Close()
 
-	fs, err := client.NewFS(remotePath)
-	if err != nil {
-		client.Close()
-		os.RemoveAll(mountDir)
-		return nil, fmt.Errorf("new fs: %w", err)
-	}
+	return m, nil
+}
 
-	backend := backend.New(func() nfsFs.FS { return fs }, auth.Null)
-	svr, err := server.NewServerTCP(listen, backend)
-	if err != nil {
-		fs.Close()
-		client.Close()
-		os.RemoveAll(mountDir)
-		return nil, fmt.Errorf("new server: %w", err)
+// autoMountDir picks the default mountpoint for name under mountBase (or
+// stateDir/mnt), adding a numeric suffix when the directory already belongs
+// to another mount so two targets that derive the same name never share a
+// directory.
+func (d *Daemon) autoMountDir(name, mountBase string) (string, error) {
+	if mountBase == "" {
+		mountBase = filepath.Join(StateDir(), "mnt")
+	} else {
+		info, err := os.Stat(mountBase)
+		if err != nil {
+			return "", fmt.Errorf("mount base: %w", err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("mount base %s is not a directory", mountBase)
+		}
+		if err := syscall.Access(mountBase, 2); err != nil {
+			return "", fmt.Errorf("mount base %s is not writable: %w", mountBase, err)
+		}
 	}
+	return d.freeMountDir(filepath.Join(mountBase, strings.ReplaceAll(name, ":", "_"))), nil
+}
 
-	go func() {
-		if err := svr.Serve(); err != nil {
-			log.Printf("Server error: %v", err)
-		}
-	}()
+// freeMountDir returns base, or base-2, base-3... when base is taken by
+// another mount or holds files. The directory is reserved until
+// releaseMountDir, so mounts started together, as by up -f, never pick
+// the same one.
+func (d *Daemon) freeMountDir(base string) string {
+	dir := base
+	for i := 2; d.mountDirInUse(dir) || !isEmptyDir(dir) || !d.reserveMountDir(dir); i++ {
+		dir = fmt.Sprintf("%s-%d", base, i)
+	}
+	return dir
+}
 
-	time.Sleep(2 * time.Second)
+func (d *Daemon) reserveMountDir(dir string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.startingDirs[dir] {
+		return false
+	}
+	d.startingDirs[dir] = true
+	return true
+}
 
-	exec.Command("umount", "-f", mountDir).Run()
+func (d *Daemon) releaseMountDir(dir string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.startingDirs, dir)
+}
 
-	port := strings.TrimPrefix(listen, ":")
-	mountCmd := exec.Command("mount", "-o", fmt.Sprintf("nfsvers=4,soft,noacl,tcp,port=%s", port), "-t", "nfs", "localhost:/", mountDir)
-	mountCmd.Stdout = logFile
-	mountCmd.Stderr = logFile
-	if err := mountCmd.Run(); err != nil {
-		fmt.Fprintf(logFile, "Mount failed: %v\n", err)
+// expandMountTemplate fills in a --mountpoint-template: {alias} is the SSH
+// alias, {name} the mount name and {path} the remote path, which keeps its
+// directories so mounts of one host nest under it. A home-relative path
+// goes under "home". No value can climb out of the template's directory.
+func expandMountTemplate(tmpl string, cmd Command, name string) string {
+	flat := strings.NewReplacer("/", "_", ":", "_")
+	remote := cmd.RemotePath
+	if remote == "" || remote == "~" || strings.HasPrefix(remote, "~/") {
+		remote = "home/" + strings.TrimPrefix(strings.TrimPrefix(remote, "~"), "/")
 	}
+	remote = strings.TrimPrefix(filepath.Clean("/"+remote), "/")
+	dir := strings.NewReplacer(
+		"{alias}", flat.Replace(cmd.SSHAlias),
+		"{name}", flat.Replace(name),
+		"{path}", remote,
+	).Replace(tmpl)
+	return filepath.Clean(dir)
+}
 
-	m := &mount{
-		info: &MountInfo{
-			Name:       name,
-			PID:        os.Getpid(),
-			Port:       strings.TrimPrefix(listen, ":"),
-			MountDir:   mountDir,
-			SSHAlias:   alias,
-			RemotePath: remotePath,
-			StartedAt:  time.Now(),
-			LogFile:    logFile.File.Name(),
-		},
-		logFile: logFile,
-		sshFS:   fs,
-		client:  client,
+// isEmptyDir reports whether mounting on dir hides nothing: it does not
+// exist yet or holds no entries.
+func isEmptyDir(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return os.IsNotExist(err)
 	}
+	defer f.Close()
+	names, _ := f.Readdirnames(1)
+	return len(names) == 0
+}
 
-	return m, nil
+func (d *Daemon) mountDirInUse(dir string) bool {
+	d.mu.Lock()
+	if d.startingDirs[dir] {
+		d.mu.Unlock()
+		return true
+	}
+	for _, m := range d.mounts {
+		if m.info.MountDir == dir {
+			d.mu.Unlock()
+			return true
+		}
+	}
+	d.mu.Unlock()
+	return rfsmount.IsMounted(dir)
 }
 
 func (d *Daemon) handleList() Response {
@@ -344,42 +907,153 @@ func (d *Daemon) handleList() Response {
 
 	list := make([]*MountInfo, 0, len(d.mounts))
 	for _, m := range d.mounts {
-		list = append(list, m.info)
+		list = append(list, m.status())
 	}
 	return Response{OK: true, Mounts: list}
 }
 
-func (d *Daemon) handleStop(names []string) Response {
+func (d *Daemon) handleStats(names []string) Response {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if len(names) == 0 {
-		d.mu.Lock()
 		for n := range d.mounts {
 			names = append(names, n)
 		}
-		d.mu.Unlock()
+	}
+	var stats []*MountStats
+	for _, name := range names {
+		name = d.resolveName(name)
+		m, ok := d.mounts[name]
+		if !ok {
+			continue
+		}
+		st := &MountStats{Name: name, Stats: m.mnt.FS.Stats()}
+		st.ReadRate, st.WriteRate = m.rates.rates()
+		stats = append(stats, st)
+	}
+	return Response{OK: true, Stats: stats}
+}
+
+func (d *Daemon) handleRefresh(name string) Response {
+	d.mu.Lock()
+	name = d.resolveName(name)
+	m, ok := d.mounts[name]
+	d.mu.Unlock()
+	if !ok {
+		return Response{Error: "no such mount: " + name}
+	}
+	m.mnt.FS.Refresh()
+	return Response{OK: true, Mount: m.info}
+}
+
+// handleReconnect reconnects a mount at once, without waiting for the
+// monitor or a file operation to notice a dead link, and mounts it again
+// if the kernel mount was lost meanwhile.
+func (d *Daemon) handleReconnect(name string) Response {
+	d.mu.Lock()
+	name = d.resolveName(name)
+	m, ok := d.mounts[name]
+	d.mu.Unlock()
+	if !ok {
+		return Response{Error: "no such mount: " + name}
+	}
+	if err := m.mnt.FS.Reconnect(); err != nil {
+		return Response{Error: fmt.Sprintf("reconnect %s: %v", name, err)}
+	}
+	m.health.up()
+	if !d.remountIfLost(m) {
+		return Response{Error: fmt.Sprintf("%s reconnected, but mounting %s again failed", name, m.info.MountDir)}
+	}
+	return Response{OK: true, Mount: m.info}
+}
+
+func (d *Daemon) handleInspect(name string) Response {
+	d.mu.Lock()
+	name = d.resolveName(name)
+	m, ok := d.mounts[name]
+	d.mu.Unlock()
+	if !ok {
+		return Response{Error: "no such mount: " + name}
 	}
 
-	var stopped []string
+	info := m.status()
+	info.Uptime = time.Since(info.StartedAt).Round(time.Second).String()
+	info.Health = m.health.history()
+	return Response{OK: true, Mount: info}
+}
+
+// status is a copy of m's info with its current state filled in.
+func (m *mount) status() *MountInfo {
+	info := *m.info
+	info.Connected = m.mnt.Client.IsConnected()
+	info.Flapping = m.health.flapping()
+	info.Mounted = info.Export || rfsmount.IsMounted(info.MountDir)
+	return &info
+}
+
+func (d *Daemon) handleStop(cmd Command) Response {
+	names := cmd.Names
+	d.mu.Lock()
+	if cmd.All {
+		names = names[:0]
+		for n := range d.mounts {
+			names = append(names, n)
+		}
+	} else if cmd.Port != "" {
+		for n, m := range d.mounts {
+			if m.info.Port == cmd.Port {
+				names = append(names, n)
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	if len(names) == 0 {
+		switch {
+		case cmd.All:
+			return Response{OK: true}
+		case cmd.Port != "":
+			return Response{Error: fmt.Sprintf("no mount on port %s", cmd.Port)}
+		}
+		return Response{Error: "no mount given; use --all to stop every mount"}
+	}
+
+	var stopped, unmountFailed []string
 	for _, name := range names {
 		d.mu.Lock()
+		name = d.resolveName(name)
 		m, ok := d.mounts[name]
 		d.mu.Unlock()
 		if !ok {
 			continue
 		}
 
-		exec.Command("umount", "-f", m.info.MountDir).Run()
-
-		if m.sshFS != nil {
-			m.sshFS.Close()
+		m.mu.Lock()
+		if m.stopped {
+			m.mu.Unlock()
+			continue
 		}
-		if m.client != nil {
-			m.client.Close()
+		m.stopped = true
+		close(m.done)
+		m.mu.Unlock()
+
+		var unmountErr error
+		if !m.info.Export {
+			unmountErr = rfsmount.Unmount(m.info.MountDir)
 		}
+
+		m.retire()
 		if m.logFile != nil {
 			m.logFile.Close()
 		}
 
-		os.RemoveAll(m.info.MountDir)
+		if unmountErr != nil {
+			ssh.Warnf("unmount %s: %v", m.info.MountDir, unmountErr)
+			unmountFailed = append(unmountFailed, fmt.Sprintf("%s: %v", name, unmountErr))
+		} else if !m.info.Export && m.createdDir && !cmd.KeepDir {
+			removeCreatedMountDir(m.info.MountDir)
+		}
 
 		d.mu.Lock()
 		delete(d.mounts, name)
@@ -388,7 +1062,68 @@ func (d *Daemon) handleStop(names []string) Response {
 		stopped = append(stopped, name)
 	}
 
-	return Response{OK: true, Names: stopped}
+	return Response{OK: true, Names: stopped, Failed: unmountFailed}
+}
+
+// removeCreatedMountDir removes a mountpoint rfs created once it is
+// unmounted. Only those under the state directory are removed with their
+// contents; elsewhere, as with --base or --mountpoint-template, an empty
+// directory is removed and anything else left alone.
+func removeCreatedMountDir(dir string) {
+	if strings.HasPrefix(dir, StateDir()+string(filepath.Separator)) {
+		os.RemoveAll(dir)
+		return
+	}
+	os.Remove(dir)
+}
+
+// remountIfLost re-runs mount(8) when the kernel dropped the mount, e.g. a
+// soft mount that timed out while the SSH link was down.
+func (d *Daemon) remountIfLost(m *mount) bool {
+	if m.info.Export || rfsmount.IsMounted(m.info.MountDir) {
+		return true
+	}
+	m.mu.Lock()
+	stopped := m.stopped
+	m.mu.Unlock()
+	if stopped {
+		return false
+	}
+	ssh.Infof("%s is no longer mounted, mounting again", m.info.MountDir)
+	if err := m.mnt.Remount(); err != nil {
+		ssh.Warnf("remount %s: %v", m.info.MountDir, err)
+		return false
+	}
+	if !rfsmount.IsMounted(m.info.MountDir) {
+		return false
+	}
+	m.health.record("remounted")
+	return true
+}
+
+// resolveName returns the key of the mount called name, falling back to a
+// mount whose alias:path derives that name. d.mu must be held.
+func (d *Daemon) resolveName(name string) string {
+	if _, ok := d.mounts[name]; ok {
+		return name
+	}
+	for n, m := range d.mounts {
+		if MountName(m.info.SSHAlias, m.info.RemotePath) == name {
+			return n
+		}
+	}
+	return name
+}
+
+// watchServer tears the mount down as soon as its NFS server stops serving,
+// instead of leaving it for the monitor to notice the dead mountpoint.
+func (d *Daemon) watchServer(name string, m *mount) {
+	select {
+	case err := <-m.mnt.Served():
+		ssh.Warnf("Server for %s exited: %v", name, err)
+		d.handleStop(Command{Names: []string{name}})
+	case <-m.done:
+	}
 }
 
 func (d *Daemon) saveState(name string, info *MountInfo) {
@@ -403,39 +1138,57 @@ func (d *Daemon) deleteState(name string) {
 func (d *Daemon) cleanupDisconnected() {
 	d.mu.Lock()
 	var toStop []string
+	lost := map[string]*mount{}
 	for name, m := range d.mounts {
-		if time.Since(m.createdAt) < 10*time.Second {
+		if time.Since(m.createdAt) < d.probeGrace {
 			continue
 		}
-		connected := m.client == nil || m.client.IsConnected()
-		mounted := isMounted(m.info.MountDir)
+		connected := m.mnt.Client.IsConnected()
+		mounted := m.info.Export || rfsmount.IsMounted(m.info.MountDir)
 		if !connected {
+			m.health.down()
+			if m.mnt.Client.Reconnecting() {
+				ssh.Debugf("cleanup: %s disconnected, reconnecting in the background", name)
+				continue
+			}
+			if !m.health.shouldStop() {
+				ssh.Debugf("cleanup: %s disconnected, but flapping; giving it time to recover", name)
+				continue
+			}
 			toStop = append(toStop, name)
-			log.Printf("cleanup: %s disconnected", name)
+			ssh.Infof("cleanup: %s disconnected", name)
 			continue
 		}
+		m.health.up()
 		if !mounted {
-			toStop = append(toStop, name)
-			log.Printf("cleanup: %s not mounted (path=%s)", name, m.info.MountDir)
+			lost[name] = m
+			continue
+		}
+		if m.info.IdleTimeout > 0 {
+			if idle := time.Since(m.mnt.FS.LastActivity()); idle > m.info.IdleTimeout {
+				toStop = append(toStop, name)
+				ssh.Infof("cleanup: %s idle for %v (timeout %v)", name, idle.Round(time.Second), m.info.IdleTimeout)
+			}
 		}
 	}
 	d.mu.Unlock()
 
-	for _, name := range toStop {
-		d.handleStop([]string{name})
+	// mount(8) can hang on a dead server, so it runs without d.mu, which
+	// every command needs.
+	for name, m := range lost {
+		if !d.remountIfLost(m) {
+			toStop = append(toStop, name)
+			ssh.Infof("cleanup: %s not mounted (path=%s)", name, m.info.MountDir)
+		}
 	}
-}
 
-func isMounted(path string) bool {
-	out, err := exec.Command("mount").Output()
-	if err != nil {
-		return false
+	for _, name := range toStop {
+		d.handleStop(Command{Names: []string{name}})
 	}
-	return strings.Contains(string(out), " on "+path+" ")
 }
 
 func (d *Daemon) monitorMounts() {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(d.probeInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
@@ -443,12 +1196,104 @@ func (d *Daemon) monitorMounts() {
 	}
 }
 
-func findFreePort() (string, error) {
-	l, err := net.Listen("tcp", ":0")
+// listenAddr returns the address the server of a mount listens on: port
+// on host if one was asked for and it is free, otherwise a free port. The
+// address is reserved until the caller calls releasePort.
+func (d *Daemon) listenAddr(host, port string) (string, error) {
+	if port == "" {
+		return d.findFreePort(host)
+	}
+	addr := net.JoinHostPort(host, port)
+	if !d.reservePort(addr) {
+		return "", fmt.Errorf("port %s is already taken by a mount being started", port)
+	}
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
+		d.releasePort(addr)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return "", fmt.Errorf("port %s is already in use on %s", port, host)
+		}
 		return "", err
 	}
-	defer l.Close()
-	addr := l.Addr().(*net.TCPAddr)
-	return fmt.Sprintf(":%d", addr.Port), nil
+	l.Close()
+	return addr, nil
+}
+
+// reservePort claims addr for a mount being started, so that mounts
+// started together are not handed the same free port before either
+// listens on it. It reports false if addr is claimed already.
+func (d *Daemon) reservePort(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.starting[addr] {
+		return false
+	}
+	d.starting[addr] = true
+	return true
+}
+
+func (d *Daemon) releasePort(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.starting, addr)
+}
+
+// findFreePort picks a port on host that nothing listens on, from the
+// configured range when there is one and from the OS otherwise.
+func (d *Daemon) findFreePort(host string) (string, error) {
+	if d.portMin > 0 {
+		for port := d.portMin; port <= d.portMax; port++ {
+			addr := net.JoinHostPort(host, strconv.Itoa(port))
+			if !d.reservePort(addr) {
+				continue
+			}
+			if l, err := net.Listen("tcp", addr); err == nil {
+				l.Close()
+				return addr, nil
+			}
+			d.releasePort(addr)
+		}
+		return "", fmt.Errorf("no free port in the local port range %d-%d on %s", d.portMin, d.portMax, host)
+	}
+	for range 10 {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return "", err
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+		l.Close()
+		if d.reservePort(addr) {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("no free port on %s", host)
+}
+
+// parsePortRange parses a --local-port-range of the form lo-hi. An empty
+// range gives 0, 0.
+func parsePortRange(s string) (lo, hi int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	a, b, ok := strings.Cut(s, "-")
+	lo, errLo := strconv.Atoi(strings.TrimSpace(a))
+	hi, errHi := strconv.Atoi(strings.TrimSpace(b))
+	if !ok || errLo != nil || errHi != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("port range must be lo-hi within 1-65535, not %q", s)
+	}
+	return lo, hi, nil
+}
+
+// envDuration reads a duration from the environment variable name, giving
+// def when it is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as 30s, not %q", name, v)
+	}
+	return d, nil
 }
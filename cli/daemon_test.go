@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFreeMountDirReserves(t *testing.T) {
+	d := NewDaemon()
+	base := filepath.Join(t.TempDir(), "host_path")
+
+	const n = 8
+	dirs := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dirs[i] = d.freeMountDir(base)
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if seen[dir] {
+			t.Fatalf("%s handed out twice: %v", dir, dirs)
+		}
+		seen[dir] = true
+	}
+
+	d.releaseMountDir(base)
+	if got := d.freeMountDir(base); got != base {
+		t.Fatalf("after release got %s, want %s", got, base)
+	}
+}
+
+func TestAutoMountDirCollisions(t *testing.T) {
+	d := NewDaemon()
+	mountBase := t.TempDir()
+
+	// host:a and host_a both derive host_a.
+	first, err := d.autoMountDir("host:a", mountBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mounts["host:a"] = &mount{info: &MountInfo{MountDir: first}}
+	d.releaseMountDir(first)
+
+	second, err := d.autoMountDir("host_a", mountBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(mountBase, "host_a"); first != want {
+		t.Fatalf("first mount got %s, want %s", first, want)
+	}
+	if want := filepath.Join(mountBase, "host_a-2"); second != want {
+		t.Fatalf("colliding mount got %s, want %s", second, want)
+	}
+	d.releaseMountDir(second)
+
+	// A directory holding files is skipped even without a mount.
+	if err := os.MkdirAll(filepath.Join(mountBase, "host_a-2", "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	third, err := d.autoMountDir("host_a", mountBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(mountBase, "host_a-3"); third != want {
+		t.Fatalf("with host_a-2 not empty got %s, want %s", third, want)
+	}
+}
+
+func TestHandleStopNothingToStop(t *testing.T) {
+	d := NewDaemon()
+	if resp := d.handleStop(Command{All: true}); !resp.OK {
+		t.Errorf("down --all with no mounts failed: %s", resp.Error)
+	}
+	if resp := d.handleStop(Command{Port: "2049"}); resp.OK || resp.Error != "no mount on port 2049" {
+		t.Errorf("down --port 2049 with no mount there = %+v, want an error", resp)
+	}
+	if resp := d.handleStop(Command{}); resp.OK {
+		t.Error("down with no target succeeded")
+	}
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"rfs/ssh"
+)
+
+type check struct {
+	name string
+	run  func() error
+	hint string
+}
+
+func runDoctor(args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage:", binaryName, "doctor [alias]")
+		os.Exit(1)
+	}
+
+	checks := []check{
+		{"mount on PATH", lookPath("mount"), "install util-linux (Linux) or check PATH"},
+		{"umount on PATH", lookPath("umount"), "install util-linux (Linux) or check PATH"},
+		{"NFS client", checkNFSClient, nfsClientHint()},
+		{"state dir writable", checkStateDir, "fix permissions on " + stateDir + " or set RFS_STATE_DIR"},
+	}
+	if len(args) == 1 {
+		alias := args[0]
+		checks = append(checks, check{"ssh -G " + alias, func() error { return checkAlias(alias) }, "add a Host entry for " + alias + " to ~/.ssh/config"})
+	}
+	checks = append(checks, check{"ssh agent", checkAgent, "start ssh-agent and export SSH_AUTH_SOCK, or set IdentityFile in ~/.ssh/config"})
+
+	failed := false
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			failed = true
+			fmt.Printf("FAIL  %-24s %v\n", c.name, err)
+			fmt.Printf("      %-24s hint: %s\n", "", c.hint)
+			continue
+		}
+		fmt.Printf("ok    %s\n", c.name)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func lookPath(name string) func() error {
+	return func() error {
+		_, err := exec.LookPath(name)
+		return err
+	}
+}
+
+func checkNFSClient() error {
+	switch runtime.GOOS {
+	case "darwin":
+		if _, err := os.Stat("/sbin/mount_nfs"); err != nil {
+			return err
+		}
+		return nil
+	case "linux":
+		if _, err := exec.LookPath("mount.nfs"); err == nil {
+			return nil
+		}
+		if _, err := os.Stat("/sbin/mount.nfs"); err == nil {
+			return nil
+		}
+		return fmt.Errorf("mount.nfs not found")
+	default:
+		return fmt.Errorf("unsupported OS %s", runtime.GOOS)
+	}
+}
+
+func nfsClientHint() string {
+	if runtime.GOOS == "linux" {
+		return "install nfs-common (Debian/Ubuntu) or nfs-utils (Fedora/Arch)"
+	}
+	return "NFS client support is required to mount"
+}
+
+func checkStateDir() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(stateDir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkAlias(alias string) error {
+	hc, err := ssh.LookupConfig(alias)
+	if err != nil {
+		return err
+	}
+	if hc.Hostname == "" {
+		return fmt.Errorf("no hostname in ssh -G output")
+	}
+	return nil
+}
+
+func checkAgent() error {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", filepath.Clean(sock))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+
+	rfsmount "rfs/mount"
+	"rfs/ssh"
+)
+
+// runDryRun prints what up would do for cmd: the resolved ssh config, the
+// remote root, the mountpoint and the mount(8) command line. It connects
+// over SSH to resolve the root but starts no NFS server and mounts nothing.
+func runDryRun(cmd Command) error {
+	log.SetOutput(io.Discard)
+
+	name := cmd.Name
+	if name == "" {
+		name = MountName(cmd.SSHAlias, cmd.RemotePath)
+	}
+
+	hc, err := ssh.LookupConfig(cmd.SSHAlias)
+	if err != nil {
+		return fmt.Errorf("ssh -G %s: %w", cmd.SSHAlias, err)
+	}
+	fmt.Printf("%-16s %s\n", "name", name)
+	fmt.Printf("%-16s %s\n", "alias", cmd.SSHAlias)
+	fmt.Printf("%-16s %s@%s\n", "host", hc.User, net.JoinHostPort(hc.Hostname, hc.Port))
+	fmt.Printf("%-16s %s\n", "identity agents", strings.Join(hc.IdentityAgents, ", "))
+	fmt.Printf("%-16s %s\n", "identity files", strings.Join(hc.IdentityFiles, ", "))
+	for _, e := range hc.KeyErrors {
+		fmt.Printf("%-16s %s\n", "key error", e)
+	}
+
+	if cmd.IdentityFile != "" {
+		fmt.Printf("%-16s %s (only key offered)\n", "key", cmd.IdentityFile)
+	} else if cmd.IdentitiesOnly || hc.IdentitiesOnly {
+		fmt.Printf("%-16s %s\n", "identities only", "yes (agent keys limited to the identity files)")
+	}
+
+	if cmd.SFTPServer != "" {
+		fmt.Printf("%-16s %s\n", "sftp server", cmd.SFTPServer)
+	}
+	if cmd.ReadOnly {
+		fmt.Printf("%-16s %s\n", "read only", "yes")
+	}
+	if cmd.Pre != "" {
+		fmt.Printf("%-16s %s (not run)\n", "pre command", cmd.Pre)
+	}
+
+	client, err := ssh.Connect(cmd.SSHAlias, ssh.Options{IdentityFile: cmd.IdentityFile, IdentitiesOnly: cmd.IdentitiesOnly, SFTPServer: cmd.SFTPServer, ConnectTimeout: cmd.ConnectTimeout})
+	if err != nil {
+		return fmt.Errorf("ssh connect: %w", err)
+	}
+	defer client.Close()
+
+	fsRoot := cmd.RemotePath
+	if cmd.CwdFromShell && (fsRoot == "" || fsRoot == "~") {
+		if fsRoot, err = client.ShellCwd(); err != nil {
+			return err
+		}
+	}
+	fs, err := client.NewFS(fsRoot)
+	if err != nil {
+		return fmt.Errorf("new fs: %w", err)
+	}
+	defer fs.Close()
+	fmt.Printf("%-16s %s\n", "remote root", fs.RootDir())
+	if err := fs.CheckRoot(); err != nil {
+		fmt.Printf("%-16s %v\n", "warning", err)
+	}
+
+	bind := cmd.Bind
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	port := cmd.Port
+	if port == "" {
+		port = "<free port>"
+	}
+	fmt.Printf("%-16s %s\n", "nfs listen", net.JoinHostPort(bind, port))
+	if cmd.Export {
+		fmt.Printf("%-16s %s\n", "mountpoint", "none (--export)")
+		return nil
+	}
+
+	mountDir := cmd.MountDir
+	switch {
+	case mountDir == "" && cmd.MountTemplate != "":
+		mountDir = NewDaemon().freeMountDir(expandMountTemplate(cmd.MountTemplate, cmd, name))
+	case mountDir == "":
+		mountDir, err = NewDaemon().autoMountDir(name, cmd.MountBase)
+	case cmd.Into:
+		mountDir, err = NewDaemon().autoMountDir(name, mountDir)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-16s %s\n", "mountpoint", mountDir)
+	if !isEmptyDir(mountDir) && !cmd.Force {
+		fmt.Printf("%-16s %s is not empty; up will refuse without --force\n", "warning", mountDir)
+	}
+	fmt.Printf("%-16s mount %s\n", "mount command", strings.Join(rfsmount.MountArgs(port, filepath.Clean(mountDir), cmd.RSize, cmd.WSize), " "))
+	return nil
+}
@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"rfs/ssh"
+)
+
+// ExecFrame is one message of the stream the daemon sends back for an exec
+// command: a chunk of output, or the final exit status or error.
+type ExecFrame struct {
+	Stream string `json:"stream,omitempty"` // "stdout" or "stderr"
+	Data   []byte `json:"data,omitempty"`
+	Exit   *int   `json:"exit,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func runExec(args []string) {
+	sep := -1
+	for i, a := range args {
+		if a == "--" {
+			sep = i
+			break
+		}
+	}
+	if sep != 1 || len(args) < 3 {
+		fmt.Println("Usage:", binaryName, "exec <alias>[:<path>] -- <command> [args...]")
+		os.Exit(1)
+	}
+	alias, _ := ParseTarget(args[0])
+	cmd := Command{Type: "exec", Name: ResolveMountName(args[0]), SSHAlias: alias, Argv: args[2:]}
+
+	conn, err := connect()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	cmd.Token = os.Getenv("RFS_TOKEN")
+	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var f ExecFrame
+		if err := dec.Decode(&f); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: lost connection to daemon:", err)
+			os.Exit(255)
+		}
+		switch {
+		case f.Error != "":
+			fmt.Fprintln(os.Stderr, "Error:", f.Error)
+			os.Exit(255)
+		case f.Exit != nil:
+			os.Exit(*f.Exit)
+		case f.Stream == "stderr":
+			os.Stderr.Write(f.Data)
+		default:
+			os.Stdout.Write(f.Data)
+		}
+	}
+}
+
+// handleExec runs cmd.Argv over the SSH connection of the mount it names,
+// or of any mount of the same alias, connecting afresh only when there is
+// none, and streams the output back as ExecFrames.
+func (d *Daemon) handleExec(conn net.Conn, cmd Command) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(conn)
+	send := func(f ExecFrame) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(f)
+	}
+
+	client, release, err := d.clientFor(cmd)
+	if err != nil {
+		send(ExecFrame{Error: err.Error()})
+		return
+	}
+	defer release()
+
+	code, err := client.Run(shellJoin(cmd.Argv), &frameWriter{"stdout", send}, &frameWriter{"stderr", send})
+	if err != nil {
+		send(ExecFrame{Error: err.Error()})
+		return
+	}
+	send(ExecFrame{Exit: &code})
+}
+
+// clientFor returns the SSH connection of the mount cmd names, or of any
+// mount of the same alias, connecting afresh only when there is none.
+// release closes a fresh connection and leaves a mount's alone.
+func (d *Daemon) clientFor(cmd Command) (client *ssh.SSHClient, release func(), err error) {
+	d.mu.Lock()
+	if m, ok := d.mounts[d.resolveName(cmd.Name)]; ok && cmd.Name != "" {
+		client = m.mnt.Client
+	} else {
+		for _, m := range d.mounts {
+			if m.info.SSHAlias == cmd.SSHAlias {
+				client = m.mnt.Client
+				break
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	release = func() {}
+	if client == nil {
+		c, err := ssh.Connect(cmd.SSHAlias, ssh.Options{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("ssh connect: %w", err)
+		}
+		client, release = c, func() { c.Close() }
+	}
+	if err := client.EnsureConnected(); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return client, release, nil
+}
+
+type frameWriter struct {
+	stream string
+	send   func(ExecFrame)
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.send(ExecFrame{Stream: w.stream, Data: append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+// shellJoin quotes argv for the remote shell, so arguments arrive as typed.
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, a := range argv {
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
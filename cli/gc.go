@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	rfsmount "rfs/mount"
+	"rfs/ssh"
+)
+
+// gcGrace spares mountpoints younger than this, which a mount being
+// started may have just created.
+const gcGrace = time.Minute
+
+// mounted is rfsmount.IsMounted, swapped out by tests.
+var mounted = rfsmount.IsMounted
+
+// collectGarbage removes what crashed daemons left in the state directory:
+// state files of mounts no longer served, with their mountpoints when
+// those are unmounted and rfs's own, and, with logs, their log files. Empty
+// directories under stateDir/mnt that no mount uses go too. Mountpoints
+// outside the state directory are the user's and are left alone. It
+// returns what it removed and, for what it had to keep, why. With dryRun
+// nothing is removed.
+func (d *Daemon) collectGarbage(dryRun, logs bool) (removed, kept []string) {
+	remove := func(p string, rm func(string) error) {
+		if !dryRun {
+			if err := rm(p); err != nil {
+				kept = append(kept, fmt.Sprintf("%s: %v", p, err))
+				return
+			}
+		}
+		removed = append(removed, p)
+	}
+
+	d.mu.Lock()
+	live := make(map[string]bool, len(d.mounts))
+	liveDirs := make(map[string]bool, len(d.mounts))
+	for name, m := range d.mounts {
+		live[name] = true
+		liveDirs[m.info.MountDir] = true
+	}
+	d.mu.Unlock()
+
+	tmpDir := filepath.Join(StateDir(), "tmp")
+	entries, _ := os.ReadDir(tmpDir)
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".state")
+		if !ok || live[name] {
+			continue
+		}
+		statePath := filepath.Join(tmpDir, e.Name())
+		var info MountInfo
+		if data, err := os.ReadFile(statePath); err == nil && json.Unmarshal(data, &info) == nil &&
+			!info.Export && info.MountDir != "" && !liveDirs[info.MountDir] {
+			if mounted(info.MountDir) {
+				kept = append(kept, fmt.Sprintf("%s: %s is still mounted, but no longer served; unmount it with umount -f", statePath, info.MountDir))
+				continue
+			}
+			if ownMountDir(info.MountDir) && dirExists(info.MountDir) {
+				remove(info.MountDir, os.Remove)
+			}
+		}
+		remove(statePath, os.Remove)
+		if logs {
+			paths, _ := filepath.Glob(filepath.Join(tmpDir, name+".log*"))
+			for _, p := range paths {
+				remove(p, os.Remove)
+			}
+		}
+	}
+
+	mntDir := filepath.Join(StateDir(), "mnt")
+	entries, _ = os.ReadDir(mntDir)
+	for _, e := range entries {
+		dir := filepath.Join(mntDir, e.Name())
+		if !e.IsDir() || liveDirs[dir] || mounted(dir) || slices.Contains(removed, dir) {
+			continue
+		}
+		if info, err := e.Info(); err != nil || time.Since(info.ModTime()) < gcGrace {
+			continue
+		}
+		if !isEmptyDir(dir) {
+			kept = append(kept, fmt.Sprintf("%s: not empty", dir))
+			continue
+		}
+		remove(dir, os.Remove)
+	}
+	return removed, kept
+}
+
+// ownMountDir reports whether dir is a mountpoint rfs created for itself,
+// under the state directory.
+func ownMountDir(dir string) bool {
+	return strings.HasPrefix(dir, StateDir()+string(filepath.Separator))
+}
+
+func dirExists(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// cleanupStaleState runs collectGarbage as the daemon starts, when no
+// mount is served yet, keeping the logs of the mounts it finds dead as the
+// only account of what happened to them.
+func (d *Daemon) cleanupStaleState() {
+	removed, kept := d.collectGarbage(false, false)
+	for _, p := range removed {
+		ssh.Debugf("gc: removed %s", p)
+	}
+	for _, k := range kept {
+		ssh.Warnf("gc: kept %s", k)
+	}
+}
+
+func (d *Daemon) handleGC(cmd Command) Response {
+	removed, kept := d.collectGarbage(cmd.DryRun, true)
+	return Response{OK: true, Names: removed, Failed: kept}
+}
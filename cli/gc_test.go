@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	oldStateDir, oldMounted := stateDir, mounted
+	t.Cleanup(func() { stateDir, mounted = oldStateDir, oldMounted })
+	stateDir = t.TempDir()
+	outside := t.TempDir()
+	tmpDir := filepath.Join(stateDir, "tmp")
+	busy := filepath.Join(stateDir, "mnt", "busy")
+	mounted = func(dir string) bool { return dir == busy }
+
+	state := func(name, mountDir string) string {
+		p := filepath.Join(tmpDir, name+".state")
+		data, _ := json.Marshal(&MountInfo{Name: name, MountDir: mountDir})
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	dead := filepath.Join(stateDir, "mnt", "dead")
+	for _, dir := range []string{tmpDir, dead, busy} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadState := state("dead", dead)
+	deadLog := filepath.Join(tmpDir, "dead.log")
+	if err := os.WriteFile(deadLog, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	busyState := state("busy", busy)
+	outsideState := state("outside", outside)
+
+	d := NewDaemon()
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	removed, _ := d.collectGarbage(true, true)
+	if len(removed) == 0 {
+		t.Fatal("dry run reported nothing to remove")
+	}
+	for _, p := range removed {
+		if !exists(p) {
+			t.Fatalf("dry run removed %s", p)
+		}
+	}
+
+	removed, kept := d.collectGarbage(false, true)
+	for _, p := range []string{deadState, dead, deadLog, outsideState} {
+		if !slices.Contains(removed, p) || exists(p) {
+			t.Errorf("%s not removed; removed %v", p, removed)
+		}
+	}
+	for _, p := range []string{busyState, busy, outside} {
+		if slices.Contains(removed, p) || !exists(p) {
+			t.Errorf("%s removed", p)
+		}
+	}
+	if len(kept) != 1 || !strings.HasPrefix(kept[0], busyState) {
+		t.Errorf("kept = %v, want the still mounted %s reported", kept, busy)
+	}
+}
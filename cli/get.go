@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"rfs/ssh"
+)
+
+// getter copies a remote tree to local disk straight over SFTP, without the
+// daemon, the NFS server or mount(8).
+type getter struct {
+	fs        *ssh.SSHFS
+	files     int
+	bytes     int64
+	current   string
+	lastPrint time.Time
+}
+
+func runGet(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage:", binaryName, "get <alias>[:<path>] <localdir>")
+		os.Exit(1)
+	}
+	alias, remotePath := ParseTarget(args[0])
+	localDir := args[1]
+
+	log.SetOutput(io.Discard)
+
+	client, err := ssh.Connect(alias, ssh.Options{})
+	if err != nil {
+		fmt.Println("Error: ssh connect:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	fs, err := client.NewFS(remotePath)
+	if err != nil {
+		fmt.Println("Error: new fs:", err)
+		os.Exit(1)
+	}
+	defer fs.Close()
+
+	g := &getter{fs: fs}
+	err = g.copyDir(".", localDir)
+	g.printProgress(true)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func (g *getter) copyDir(remoteDir, localDir string) error {
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return err
+	}
+
+	dir, err := g.fs.Open(remoteDir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remoteDir, err)
+	}
+	entries, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", remoteDir, err)
+	}
+
+	for _, e := range entries {
+		remotePath := path.Join(remoteDir, e.Name())
+		localPath := filepath.Join(localDir, e.Name())
+		switch {
+		case e.Mode()&os.ModeSymlink != 0:
+			target, err := g.fs.Readlink(remotePath)
+			if err != nil {
+				return fmt.Errorf("%s: %w", remotePath, err)
+			}
+			os.Remove(localPath)
+			if err := os.Symlink(target, localPath); err != nil {
+				return err
+			}
+		case e.IsDir():
+			if err := g.copyDir(remotePath, localPath); err != nil {
+				return err
+			}
+		case e.Mode().IsRegular():
+			if err := g.copyFile(remotePath, localPath, e.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *getter) copyFile(remotePath, localPath string, perm os.FileMode) error {
+	src, err := g.fs.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remotePath, err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	g.current = remotePath
+	_, err = io.Copy(dst, io.TeeReader(src, g))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", remotePath, err)
+	}
+	g.files++
+	g.printProgress(false)
+	return nil
+}
+
+// Write counts bytes flowing through copyFile for the progress line.
+func (g *getter) Write(p []byte) (int, error) {
+	g.bytes += int64(len(p))
+	g.printProgress(false)
+	return len(p), nil
+}
+
+func (g *getter) printProgress(force bool) {
+	if !force && time.Since(g.lastPrint) < 200*time.Millisecond {
+		return
+	}
+	g.lastPrint = time.Now()
+	fmt.Fprintf(os.Stderr, "\r\033[K%d files  %s  %s", g.files, formatBytes(g.bytes), g.current)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
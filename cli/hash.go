@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+)
+
+func runHash(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage:", binaryName, "hash <alias>:<path>")
+		os.Exit(1)
+	}
+	alias, path := ParseTarget(args[0])
+	resp := SendCmd(Command{Type: "hash", SSHAlias: alias, RemotePath: path})
+	if resp.Error != "" {
+		fmt.Println("Error:", resp.Error)
+		os.Exit(1)
+	}
+	fmt.Printf("%s  %s\n", resp.Hash, path)
+}
+
+// handleHash computes the SHA-256 of a remote file over the connection of a
+// mount of the same alias when there is one.
+func (d *Daemon) handleHash(cmd Command) Response {
+	client, release, err := d.clientFor(cmd)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	defer release()
+	sum, err := client.SHA256(cmd.RemotePath)
+	if err != nil {
+		return Response{Error: fmt.Sprintf("%s: %v", cmd.RemotePath, err)}
+	}
+	return Response{OK: true, Hash: sum}
+}
@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// healthEvents is how many state changes a mount remembers.
+	healthEvents = 32
+
+	// A mount that lost its connection flapThreshold times within
+	// flapWindow is flapping: its link comes back, so rather than being
+	// torn down at once when it drops again it gets flapGrace to recover,
+	// doubling with every further drop up to maxFlapGrace.
+	flapWindow    = 10 * time.Minute
+	flapThreshold = 3
+	flapGrace     = 30 * time.Second
+	maxFlapGrace  = 10 * time.Minute
+)
+
+// HealthEvent is one state change of a mount: "up", "disconnected",
+// "reconnected" or "remounted".
+type HealthEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+}
+
+// health tracks the connection state of a mount and its recent changes.
+type health struct {
+	mu        sync.Mutex
+	events    []HealthEvent // oldest first
+	connected bool
+	downSince time.Time
+}
+
+func newHealth() *health {
+	h := &health{connected: true}
+	h.recordLocked("up")
+	return h
+}
+
+func (h *health) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recordLocked(event)
+}
+
+func (h *health) recordLocked(event string) {
+	if len(h.events) == healthEvents {
+		copy(h.events, h.events[1:])
+		h.events = h.events[:healthEvents-1]
+	}
+	h.events = append(h.events, HealthEvent{Time: time.Now(), Event: event})
+}
+
+// down notes that the connection is lost, once per outage.
+func (h *health) down() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.connected {
+		h.connected = false
+		h.downSince = time.Now()
+		h.recordLocked("disconnected")
+	}
+}
+
+// up notes that the connection is back.
+func (h *health) up() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.connected {
+		h.connected = true
+		h.recordLocked("reconnected")
+	}
+}
+
+func (h *health) history() []HealthEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HealthEvent(nil), h.events...)
+}
+
+// drops counts the outages within flapWindow.
+func (h *health) drops() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, e := range h.events {
+		if e.Event == "disconnected" && time.Since(e.Time) < flapWindow {
+			n++
+		}
+	}
+	return n
+}
+
+func (h *health) flapping() bool {
+	return h.drops() >= flapThreshold
+}
+
+// shouldStop reports whether a disconnected mount has been down longer
+// than its grace period: none normally, so a dead server is let go at
+// once, and growing with every drop while it flaps.
+func (h *health) shouldStop() bool {
+	n := h.drops()
+	h.mu.Lock()
+	downFor := time.Since(h.downSince)
+	h.mu.Unlock()
+	if n < flapThreshold {
+		return true
+	}
+	grace := maxFlapGrace
+	if shift := n - flapThreshold; shift < 10 {
+		grace = min(flapGrace<<shift, maxFlapGrace)
+	}
+	return downFor >= grace
+}
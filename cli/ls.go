@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sortMounts orders mounts for ls: by alias then path, by uptime with the
+// longest running first, or by port. Ties fall back to the name order, so
+// the output is the same on every run.
+func sortMounts(mounts []*MountInfo, by string) {
+	byName := func(a, b *MountInfo) int {
+		return cmp.Or(cmp.Compare(a.SSHAlias, b.SSHAlias), cmp.Compare(a.RemotePath, b.RemotePath), cmp.Compare(a.Name, b.Name))
+	}
+	slices.SortFunc(mounts, func(a, b *MountInfo) int {
+		switch by {
+		case "uptime":
+			return cmp.Or(a.StartedAt.Compare(b.StartedAt), byName(a, b))
+		case "port":
+			pa, _ := strconv.Atoi(a.Port)
+			pb, _ := strconv.Atoi(b.Port)
+			return cmp.Or(cmp.Compare(pa, pb), byName(a, b))
+		}
+		return byName(a, b)
+	})
+}
+
+// mountState sums up a mount's health for ls; anything but "ok" is
+// degraded.
+func mountState(m *MountInfo) string {
+	switch {
+	case !m.Connected:
+		return "disconnected"
+	case !m.Mounted:
+		return "not mounted"
+	case m.Flapping:
+		return "flapping"
+	}
+	return "ok"
+}
+
+// backoffSchedule is the reconnect delay range for ls, from the first
+// retry to the cap. State written before the schedule was recorded has
+// neither and shows as "-".
+func backoffSchedule(m *MountInfo) string {
+	if m.InitialBackoff <= 0 && m.MaxBackoff <= 0 {
+		return "-"
+	}
+	return m.InitialBackoff.String() + "-" + m.MaxBackoff.String()
+}
+
+// printMountTable prints the ls table with every column as wide as its
+// longest entry. On a terminal the state is green when healthy and red
+// otherwise, unless $NO_COLOR is set.
+func printMountTable(mounts []*MountInfo) {
+	header := []string{"ALIAS:PATH", "PORT", "STATE", "BACKOFF", "MOUNT"}
+	rows := [][]string{header}
+	for _, m := range mounts {
+		mountDir := m.MountDir
+		if m.Export {
+			mountDir = "(exported on " + m.Address + ")"
+		}
+		rows = append(rows, []string{m.SSHAlias + ":" + m.RemotePath, m.Port, mountState(m), backoffSchedule(m), mountDir})
+	}
+	widths := make([]int, len(header))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+
+	color := colorOutput()
+	for r, row := range rows {
+		var line strings.Builder
+		for i, cell := range row {
+			if i == len(row)-1 {
+				line.WriteString(cell)
+				break
+			}
+			padded := fmt.Sprintf("%-*s ", widths[i], cell)
+			if color && r > 0 && i == 2 {
+				code := "32" // green
+				if cell != "ok" {
+					code = "31" // red
+				}
+				padded = "\033[" + code + "m" + cell + "\033[0m" + padded[len(cell):]
+			}
+			line.WriteString(padded)
+		}
+		fmt.Println(line.String())
+	}
+}
+
+// colorOutput reports whether stdout is a terminal that may get colors.
+func colorOutput() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
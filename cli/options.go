@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sshfsOptions collects up's -o options, the subset of sshfs's that tune
+// the link, so sshfs command lines carry over:
+//
+//	reconnect              accepted; rfs always reconnects
+//	ServerAliveInterval=N  send a keepalive every N seconds
+//	ServerAliveCountMax=N  drop the connection after N unanswered ones
+//	ConnectTimeout=N       give up connecting after N seconds, unless
+//	                       --connect-timeout is given
+//
+// Names are case-insensitive, as in ssh_config. -o may be repeated, and
+// takes several options separated by commas.
+type sshfsOptions struct {
+	list []string
+
+	keepaliveInterval time.Duration
+	keepaliveCountMax int
+	connectTimeout    time.Duration
+}
+
+func (o *sshfsOptions) String() string {
+	return strings.Join(o.list, ",")
+}
+
+func (o *sshfsOptions) Set(value string) error {
+	for _, opt := range strings.Split(value, ",") {
+		if opt = strings.TrimSpace(opt); opt == "" {
+			continue
+		}
+		if err := o.set(opt); err != nil {
+			return err
+		}
+		o.list = append(o.list, opt)
+	}
+	return nil
+}
+
+func (o *sshfsOptions) set(opt string) error {
+	name, value, hasValue := strings.Cut(opt, "=")
+	var seconds *time.Duration
+	var count *int
+	switch strings.ToLower(name) {
+	case "reconnect":
+		if hasValue {
+			return fmt.Errorf("reconnect takes no value")
+		}
+		return nil
+	case "serveraliveinterval":
+		seconds = &o.keepaliveInterval
+	case "serveralivecountmax":
+		count = &o.keepaliveCountMax
+	case "connecttimeout":
+		seconds = &o.connectTimeout
+	default:
+		return fmt.Errorf("unsupported option %q (want reconnect, ServerAliveInterval, ServerAliveCountMax or ConnectTimeout)", name)
+	}
+	n, err := strconv.Atoi(value)
+	if !hasValue || err != nil || n < 1 {
+		return fmt.Errorf("%s needs a positive number, as in %s=15", name, name)
+	}
+	if seconds != nil {
+		*seconds = time.Duration(n) * time.Second
+	} else {
+		*count = n
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rfs/ssh"
+)
+
+// Configure applies the daemon's command line. With --listen tcp://host:port
+// the daemon also takes commands over TCP, each of which must carry the
+// token kept in --token-file; clients set RFS_DAEMON and RFS_TOKEN. The unix
+// socket is always served. --local-port-range keeps NFS servers on ports a
+// host firewall allows, and --probe-interval and --probe-grace pace the
+// monitor that notices lost connections and mounts.
+func (d *Daemon) Configure(args []string) error {
+	probeInterval, err := envDuration("RFS_PROBE_INTERVAL", d.probeInterval)
+	if err != nil {
+		return err
+	}
+	probeGrace, err := envDuration("RFS_PROBE_GRACE", d.probeGrace)
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	listen := flags.String("listen", "", "also accept commands on tcp://host:port, authenticated by the token")
+	portRange := flags.String("local-port-range", os.Getenv("RFS_PORT_RANGE"), "pick NFS server ports from lo-hi, e.g. 20000-20099, instead of any free port (default $RFS_PORT_RANGE)")
+	flags.DurationVar(&d.probeInterval, "probe-interval", probeInterval, "how often to check that every mount is connected and mounted ($RFS_PROBE_INTERVAL overrides the default)")
+	flags.DurationVar(&d.probeGrace, "probe-grace", probeGrace, "how long a new mount is left to come up before it is checked ($RFS_PROBE_GRACE overrides the default)")
+	tokenFile := flags.String("token-file", filepath.Join(StateDir(), "daemon.token"), "file holding the token for --listen, created if missing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if d.probeInterval <= 0 {
+		return fmt.Errorf("--probe-interval must be positive")
+	}
+	d.args = args
+	if d.portMin, d.portMax, err = parsePortRange(*portRange); err != nil {
+		return fmt.Errorf("--local-port-range: %w", err)
+	}
+	if *listen == "" {
+		return nil
+	}
+
+	addr, ok := strings.CutPrefix(*listen, "tcp://")
+	if !ok {
+		return fmt.Errorf("--listen must be tcp://host:port, not %q", *listen)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("--listen: %w", err)
+	}
+	token, err := loadToken(*tokenFile)
+	if err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	d.tcpAddr, d.token = addr, token
+	return nil
+}
+
+// loadToken reads the token from path, creating the file with a random
+// token, readable only by its owner, when it does not exist.
+func loadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("%s is empty", path)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (d *Daemon) authorized(token string) bool {
+	return d.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+func (d *Daemon) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			ssh.Warnf("tcp accept: %v", err)
+			return
+		}
+		go d.handleConn(conn, true)
+	}
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"sync"
+	"time"
+)
+
+// rateWindow is how far back throughput is averaged over; the counters are
+// sampled once a second.
+const rateWindow = 10 * time.Second
+
+type rateSample struct {
+	at            time.Time
+	read, written int64
+}
+
+// throughput turns a mount's byte counters into current rates.
+type throughput struct {
+	mu      sync.Mutex
+	samples []rateSample // oldest first, spanning at most rateWindow
+}
+
+// sampleRates feeds m's throughput from its counters until m is stopped.
+func sampleRates(m *mount) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			st := m.mnt.FS.Stats()
+			m.rates.add(rateSample{now, st.BytesRead, st.BytesWritten})
+		}
+	}
+}
+
+func (t *throughput) add(s rateSample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, s)
+	for len(t.samples) > 2 && s.at.Sub(t.samples[0].at) > rateWindow {
+		t.samples = t.samples[1:]
+	}
+}
+
+// rates returns bytes per second read and written over the window.
+func (t *throughput) rates() (read, written float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < 2 {
+		return 0, 0
+	}
+	first, last := t.samples[0], t.samples[len(t.samples)-1]
+	secs := last.at.Sub(first.at).Seconds()
+	return float64(last.read-first.read) / secs, float64(last.written-first.written) / secs
+}
@@ -2,7 +2,10 @@ module rfs
 
 go 1.25.6
 
-require github.com/smallfz/libnfs-go v0.0.7
+require (
+	github.com/smallfz/libnfs-go v0.0.7
+	golang.org/x/net v0.50.0
+)
 
 require (
 	github.com/kr/fs v0.1.0 // indirect
@@ -10,11 +10,17 @@ import (
 func main() {
 	if len(os.Args) >= 2 {
 		switch os.Args[1] {
-		case "up", "ls", "down", "logs":
+		case "up", "ls", "down", "unmount", "logs", "get", "exec", "hash", "refresh", "reconnect", "open", "stats", "inspect", "doctor", "gc", "shutdown", "restart-daemon":
+			cli.RunCLI()
+			return
+		case "--quiet", "-quiet", "--verbose", "-verbose":
 			cli.RunCLI()
 			return
 		case "daemon":
 			d := cli.NewDaemon()
+			if err := d.Configure(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
 			if err := d.Start(); err != nil {
 				log.Fatal(err)
 			}
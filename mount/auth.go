@@ -0,0 +1,47 @@
+package mount
+
+import (
+	"fmt"
+	"os"
+
+	"rfs/ssh"
+
+	"github.com/smallfz/libnfs-go/auth"
+	nfsFs "github.com/smallfz/libnfs-go/fs"
+	"github.com/smallfz/libnfs-go/nfs"
+)
+
+// authHandler returns the RPC credential check for the --auth mode.
+func authHandler(mode string) (nfs.AuthenticationHandler, error) {
+	switch mode {
+	case "", "sys":
+		return authSysOwner, nil
+	case "null":
+		return auth.Null, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q (want sys or null)", mode)
+	}
+}
+
+// authSysOwner accepts AUTH_SYS calls only from the uid running rfs (or
+// root, which the kernel NFS client uses for some housekeeping). AUTH_NULL
+// would skip the uid check and is refused; the client's NULL ping never
+// reaches this handler. Refusals are nfs.AuthErrors, which libnfs-go
+// answers with AUTH_ERROR, so the client sees EACCES; any other error
+// drops the connection and the client keeps reconnecting.
+func authSysOwner(cred, verf *nfs.Auth) (*nfs.Auth, nfsFs.Creds, error) {
+	if cred.Flavor != nfs.AUTH_FLAVOR_UNIX {
+		ssh.Debugf("nfs auth: flavor %d refused, AUTH_SYS required", cred.Flavor)
+		return nil, nil, nfs.ErrTooWeak
+	}
+	resp, creds, err := auth.Unix(cred, verf)
+	if err != nil || creds == nil {
+		ssh.Debugf("nfs auth: unreadable AUTH_SYS credentials: %v", err)
+		return nil, nil, nfs.ErrBadCredentials
+	}
+	if uid := creds.Uid(); uid != 0 && uid != uint32(os.Getuid()) {
+		ssh.Debugf("nfs auth: uid %d is not allowed on this mount", uid)
+		return nil, nil, nfs.ErrBadCredentials
+	}
+	return resp, creds, nil
+}
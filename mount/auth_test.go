@@ -0,0 +1,52 @@
+package mount
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/smallfz/libnfs-go/nfs"
+)
+
+// authSys encodes AUTH_SYS credentials for uid as XDR.
+func authSys(uid uint32) *nfs.Auth {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 0) // stamp
+	body = binary.BigEndian.AppendUint32(body, 4) // hostname
+	body = append(body, "host"...)
+	body = binary.BigEndian.AppendUint32(body, uid)
+	body = binary.BigEndian.AppendUint32(body, uid) // gid
+	body = binary.BigEndian.AppendUint32(body, 0)   // no other groups
+	return &nfs.Auth{Flavor: nfs.AUTH_FLAVOR_UNIX, Body: body}
+}
+
+func TestAuthSysOwner(t *testing.T) {
+	self := uint32(os.Getuid())
+	other := self + 1000
+	if self == 0 {
+		other = 1000
+	}
+	tests := []struct {
+		name string
+		cred *nfs.Auth
+		want error
+	}{
+		{"owner", authSys(self), nil},
+		{"root", authSys(0), nil},
+		{"other uid", authSys(other), nfs.ErrBadCredentials},
+		{"auth null", &nfs.Auth{Flavor: nfs.AUTH_FLAVOR_NULL}, nfs.ErrTooWeak},
+		{"truncated", &nfs.Auth{Flavor: nfs.AUTH_FLAVOR_UNIX, Body: []byte{0, 0}}, nfs.ErrBadCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, creds, err := authSysOwner(tt.cred, &nfs.Auth{})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err == nil && creds == nil {
+				t.Fatal("accepted without credentials")
+			}
+		})
+	}
+}
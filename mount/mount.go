@@ -0,0 +1,401 @@
+// Package mount serves a remote directory over SFTP as a local NFS or
+// WebDAV server and attaches it with mount(8). It is what the rfs daemon
+// runs for every mount, usable on its own by programs that embed rfs.
+package mount
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rfs/ssh"
+
+	"github.com/smallfz/libnfs-go/backend"
+	nfsFs "github.com/smallfz/libnfs-go/fs"
+	"github.com/smallfz/libnfs-go/nfs"
+	"github.com/smallfz/libnfs-go/server"
+	"golang.org/x/net/webdav"
+)
+
+// MountOptions describe a mount. Only Alias and MountDir are required;
+// the zero value of every other field is the default.
+type MountOptions struct {
+	Alias      string // SSH config alias or [user@]host[:port]
+	RemotePath string // directory to serve, relative to the login directory; "" or "~" is that directory
+	MountDir   string // existing local directory to mount on
+
+	// Listen is the address the server listens on, 127.0.0.1 on a free
+	// port by default.
+	Listen string
+	// Export serves without mounting, for another host to mount.
+	Export bool
+	// Attached says MountDir is still mounted from an earlier server on
+	// the same address, which this one takes over without remounting.
+	Attached bool
+	// Frontend is "nfs" (the default) or "webdav".
+	Frontend string
+	// WebDAVPassword is asked of WebDAV clients, which log in with HTTP
+	// Basic auth as DAVUser. Without it WebDAV is only served on loopback
+	// addresses, as anyone who can connect could change the whole tree.
+	WebDAVPassword string
+	// Auth is the NFS credential check: "sys" (the default) accepts only
+	// the current user and root, "null" anyone.
+	Auth string
+
+	SSH            ssh.Options
+	WaitForNetwork time.Duration // wait this long for the host to resolve and answer before connecting
+	CwdFromShell   bool          // take the login shell's working directory as the default RemotePath
+	Pre            string        // remote command run before the SFTP session opens; the mount fails if it does
+	NoVerify       bool          // skip checking that RemotePath is a directory
+	OpTimeout      time.Duration // see ssh.SSHFS.SetOpTimeout; zero waits forever
+	AdjustMtime    bool          // shift reported times by the measured clock skew, see ssh.SSHFS.SetMtimeShift
+
+	RateLimit      int64 // bytes per second, 0 for none
+	ReadOnly       bool
+	NoCache        bool
+	FollowSymlinks bool
+	EffectivePerms bool
+	ExactLinks     bool     // see ssh.SSHFS.SetExactLinks
+	Symlinks       string   // see ssh.SSHFS.SetSymlinkMode
+	Ignore         []string // see ssh.SSHFS.SetIgnore
+	RSize, WSize   int      // see ssh.SSHFS.SetIOSize
+	ReadCacheDir   string
+	ReadCacheSize  int64 // 0 disables the read cache
+	Prewarm        int   // list up to this many entries ahead, see ssh.SSHFS.Prewarm
+
+	// Log receives the output of mount(8); it is discarded when nil.
+	Log io.Writer
+}
+
+// DAVUser is the user name WebDAV clients log in with.
+const DAVUser = "rfs"
+
+// Mount is a running mount, see Start.
+type Mount struct {
+	FS     *ssh.SSHFS
+	Client *ssh.SSHClient
+
+	opts     MountOptions
+	port     string
+	server   *server.Server
+	listener *trackedListener // the NFS server's, closed to stop it
+	davSrv   *http.Server     // set instead of server for the webdav frontend
+	served   chan error       // receives Serve's result when the server exits
+	once     sync.Once
+
+	skew      time.Duration // see ClockSkew
+	skewKnown bool
+}
+
+// Start connects to opts.Alias, serves opts.RemotePath and, unless
+// exporting, mounts it on opts.MountDir. Nothing is left behind when it
+// fails, mount(8) failing included. WebDAV is never mounted, so it needs
+// Export.
+func Start(opts MountOptions) (*Mount, error) {
+	if opts.Listen == "" {
+		opts.Listen = "127.0.0.1:0"
+	}
+	if opts.Log == nil {
+		opts.Log = io.Discard
+	}
+	authFn, err := authHandler(opts.Auth)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Frontend == "webdav" && !opts.Export {
+		return nil, errors.New("WebDAV cannot be mounted with mount(8); set Export and mount it with a WebDAV client")
+	}
+	if opts.Frontend == "webdav" && opts.WebDAVPassword == "" && !loopback(opts.Listen) {
+		return nil, fmt.Errorf("WebDAV on %s needs a password, or a loopback address", opts.Listen)
+	}
+
+	if opts.WaitForNetwork > 0 {
+		if err := ssh.WaitForNetwork(opts.Alias, opts.WaitForNetwork); err != nil {
+			return nil, err
+		}
+	}
+	client, err := ssh.Connect(opts.Alias, opts.SSH)
+	if err != nil {
+		var hostKeyErr *ssh.HostKeyChangedError
+		if errors.As(err, &hostKeyErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("ssh connect: %w", err)
+	}
+
+	fs, err := newFS(client, opts)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	m := &Mount{FS: fs, Client: client, opts: opts, served: make(chan error, 1)}
+	m.measureSkew()
+	if err := m.serve(authFn); err != nil {
+		fs.Close()
+		client.Close()
+		return nil, err
+	}
+
+	// serve has bound the listener, so mount(8) connecting now is queued
+	// until the server accepts.
+	switch {
+	case opts.Export:
+		ssh.Infof("Exporting %s:%s on %s, not mounting locally", opts.Alias, opts.RemotePath, m.Addr())
+	case opts.Attached && IsMounted(opts.MountDir):
+		ssh.Infof("Serving %s:%s on %s under the existing mount", opts.Alias, opts.RemotePath, m.Addr())
+	default:
+		if err := m.Remount(); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// newFS runs opts.Pre, opens the SFTP session and applies the file system
+// options.
+func newFS(client *ssh.SSHClient, opts MountOptions) (*ssh.SSHFS, error) {
+	if opts.Pre != "" {
+		if err := runPre(client, opts.Pre); err != nil {
+			return nil, err
+		}
+	}
+	fsRoot := opts.RemotePath
+	if opts.CwdFromShell && (fsRoot == "" || fsRoot == "~") {
+		cwd, err := client.ShellCwd()
+		if err != nil {
+			return nil, err
+		}
+		fsRoot = cwd
+	}
+
+	// The mount only needs the SFTP subsystem, not a shell: NewFS's SFTP
+	// handshake is the liveness probe, so sftp-only and ForceCommand
+	// accounts work.
+	fs, err := client.NewFS(fsRoot)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+	if !opts.NoVerify {
+		if err := fs.CheckRoot(); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+	fs.SetRateLimit(opts.RateLimit)
+	fs.SetFollowSymlinks(opts.FollowSymlinks)
+	fs.SetNoCache(opts.NoCache)
+	fs.SetReadOnly(opts.ReadOnly)
+	fs.SetIOSize(opts.RSize, opts.WSize)
+	fs.SetExactLinks(opts.ExactLinks)
+	fs.SetOpTimeout(opts.OpTimeout)
+	if opts.ReadCacheSize > 0 {
+		if err := fs.SetReadCache(opts.ReadCacheDir, opts.ReadCacheSize); err != nil {
+			ssh.Warnf("%s: %v; reading without it", opts.Alias, err)
+		}
+	}
+	if opts.EffectivePerms {
+		if err := fs.EnableEffectivePerms(); err != nil {
+			ssh.Warnf("%s: %v; showing the server's permission bits", opts.Alias, err)
+		}
+	}
+	if err := fs.SetSymlinkMode(opts.Symlinks, opts.MountDir); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if err := fs.SetIgnore(opts.Ignore); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if opts.Prewarm > 0 {
+		go func() {
+			start := time.Now()
+			n, err := fs.Prewarm(opts.Prewarm)
+			if err != nil {
+				ssh.Warnf("%s: prewarm: %v", opts.Alias, err)
+				return
+			}
+			ssh.Infof("%s: prewarmed %d entries in %v", opts.Alias, n, time.Since(start).Round(time.Millisecond))
+		}()
+	}
+	return fs, nil
+}
+
+// runPre runs command on the connection the mount will use, failing with
+// its stderr when it exits non-zero.
+func runPre(client *ssh.SSHClient, command string) error {
+	var stderr bytes.Buffer
+	code, err := client.Run(command, io.Discard, &stderr)
+	if err != nil {
+		return fmt.Errorf("--pre: %w", err)
+	}
+	if code != 0 {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return fmt.Errorf("--pre %q exited with status %d", command, code)
+		}
+		return fmt.Errorf("--pre %q exited with status %d: %s", command, code, msg)
+	}
+	return nil
+}
+
+// serve starts the NFS or WebDAV server on opts.Listen.
+func (m *Mount) serve(authFn nfs.AuthenticationHandler) error {
+	ln, err := net.Listen("tcp", m.opts.Listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	_, m.port, _ = net.SplitHostPort(ln.Addr().String())
+
+	if m.opts.Frontend == "webdav" {
+		var h http.Handler = &webdav.Handler{
+			FileSystem: m.FS.WebDAV(),
+			LockSystem: m.FS.WebDAVLocks(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					ssh.Debugf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+				}
+			},
+		}
+		if m.opts.WebDAVPassword != "" {
+			h = davAuth(h, m.opts.WebDAVPassword)
+		}
+		m.davSrv = &http.Server{Handler: h}
+		go func() {
+			m.served <- m.davSrv.Serve(ln)
+		}()
+		return nil
+	}
+
+	m.listener = newTrackedListener(ln)
+	fs := m.FS
+	backend := backend.New(func() nfsFs.FS { return fs }, authFn)
+	m.server, err = server.NewServer(m.listener, backend)
+	if err != nil {
+		m.listener.Close()
+		return fmt.Errorf("new server: %w", err)
+	}
+	go func() {
+		m.served <- m.server.Serve()
+	}()
+	return nil
+}
+
+// davAuth lets through only requests that log in as DAVUser with
+// password.
+func davAuth(h http.Handler, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(DAVUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rfs"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loopback reports whether the listen address addr is only reachable
+// from this host.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// measureSkew measures the server's clock skew once, and applies it when
+// the options ask for adjusted times.
+func (m *Mount) measureSkew() {
+	skew, err := m.Client.MeasureClockSkew()
+	if err != nil {
+		if m.opts.AdjustMtime {
+			ssh.Warnf("%s: clock skew: %v; reporting the server's times", m.opts.Alias, err)
+		} else {
+			ssh.Debugf("%s: clock skew: %v", m.opts.Alias, err)
+		}
+		return
+	}
+	m.skew, m.skewKnown = skew, true
+	switch {
+	case m.opts.AdjustMtime:
+		m.FS.SetMtimeShift(skew)
+	case skew != 0:
+		ssh.Infof("%s: server clock is off by %v; --adjust-mtime corrects reported times", m.opts.Alias, skew)
+	}
+}
+
+// ClockSkew is how far the server's clock ran ahead of the local one when
+// the mount started, negative when behind, and whether it could be
+// measured at all.
+func (m *Mount) ClockSkew() (time.Duration, bool) {
+	return m.skew, m.skewKnown
+}
+
+// Addr is the address the server listens on.
+func (m *Mount) Addr() string {
+	host, _, _ := net.SplitHostPort(m.opts.Listen)
+	return net.JoinHostPort(host, m.port)
+}
+
+// Port is the port the server listens on.
+func (m *Mount) Port() string {
+	return m.port
+}
+
+// Served receives the server's error once it stops serving, which it
+// does on its own only when something went wrong.
+func (m *Mount) Served() <-chan error {
+	return m.served
+}
+
+// Remount runs mount(8) again, for when the kernel dropped the mount,
+// e.g. a soft mount that timed out while the SSH link was down.
+func (m *Mount) Remount() error {
+	var out bytes.Buffer
+	err := mountNFS(m.port, m.opts.MountDir, m.opts.RSize, m.opts.WSize, io.MultiWriter(m.opts.Log, &out))
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(out.String()); msg != "" {
+		return fmt.Errorf("mount %s: %w: %s", m.opts.MountDir, err, msg)
+	}
+	return fmt.Errorf("mount %s: %w", m.opts.MountDir, err)
+}
+
+// Close stops the server and the SSH connection but leaves the kernel
+// mount alone, for another server on the same address to take over.
+func (m *Mount) Close() {
+	m.once.Do(func() {
+		if m.listener != nil {
+			m.listener.Close()
+		}
+		if m.davSrv != nil {
+			m.davSrv.Close()
+		}
+		m.FS.Close()
+		m.Client.Close()
+	})
+}
+
+// Unmount detaches the mount and closes it. When the unmount fails the
+// server keeps running, so the mountpoint is not left dead.
+func (m *Mount) Unmount() error {
+	if !m.opts.Export {
+		if err := Unmount(m.opts.MountDir); err != nil {
+			return err
+		}
+	}
+	m.Close()
+	return nil
+}
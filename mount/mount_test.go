@@ -0,0 +1,69 @@
+package mount
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDavAuth(t *testing.T) {
+	h := davAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "secret")
+	tests := []struct {
+		name       string
+		user, pass string
+		basic      bool
+		want       int
+	}{
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+		{"wrong password", DAVUser, "guess", true, http.StatusUnauthorized},
+		{"wrong user", "admin", "secret", true, http.StatusUnauthorized},
+		{"right", DAVUser, "secret", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PROPFIND", "/", nil)
+			if tt.basic {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		"0.0.0.0:8080":   false,
+		"10.1.2.3:8080":  false,
+		":8080":          false,
+		"nonsense":       false,
+	}
+	for addr, want := range tests {
+		if got := loopback(addr); got != want {
+			t.Errorf("loopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestMountArgsUsesIPv4Loopback(t *testing.T) {
+	// localhost may resolve to ::1, where nothing listens.
+	args := MountArgs("2049", "/mnt/x", 0, 0)
+	if !slices.Contains(args, "127.0.0.1:/") || slices.Contains(args, "localhost:/") {
+		t.Fatalf("MountArgs = %v, want the export at 127.0.0.1:/", args)
+	}
+}
+
+func TestStartRefusesToMountWebDAV(t *testing.T) {
+	_, err := Start(MountOptions{Alias: "host", MountDir: t.TempDir(), Frontend: "webdav"})
+	if err == nil || !strings.Contains(err.Error(), "Export") {
+		t.Fatalf("err = %v, want WebDAV refused without Export", err)
+	}
+}
@@ -0,0 +1,144 @@
+package mount
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"rfs/ssh"
+)
+
+// mountNFS (re)attaches the NFS server on 127.0.0.1:port to mountDir,
+// clearing any stale mount there first.
+func mountNFS(port, mountDir string, rsize, wsize int, out io.Writer) error {
+	exec.Command("umount", "-f", mountDir).Run()
+
+	mountCmd := exec.Command("mount", MountArgs(port, mountDir, rsize, wsize)...)
+	mountCmd.Stdout = out
+	mountCmd.Stderr = out
+	return mountCmd.Run()
+}
+
+// MountArgs is the mount(8) command line that attaches the NFS server on
+// 127.0.0.1:port to mountDir. rsize and wsize, zero for the default, are
+// the same sizes the server advertises, see ssh.SSHFS.SetIOSize.
+func MountArgs(port, mountDir string, rsize, wsize int) []string {
+	if rsize <= 0 {
+		rsize = ssh.DefaultIOSize
+	}
+	if wsize <= 0 {
+		wsize = ssh.DefaultIOSize
+	}
+	opts := fmt.Sprintf("nfsvers=4,soft,noacl,tcp,port=%s,rsize=%d,wsize=%d", port, rsize, wsize)
+	return []string{"-o", opts, "-t", "nfs", "127.0.0.1:/", mountDir}
+}
+
+// Unmount force-unmounts dir, falling back to a lazy unmount when it is
+// busy. It fails if dir is still mounted afterwards, in which case the
+// caller must not remove it.
+func Unmount(dir string) error {
+	out, err := exec.Command("umount", "-f", dir).CombinedOutput()
+	if err != nil && runtime.GOOS == "linux" {
+		out, err = exec.Command("umount", "-l", dir).CombinedOutput()
+	}
+	if IsMounted(dir) {
+		if err == nil {
+			return fmt.Errorf("%s is still mounted", dir)
+		}
+		return fmt.Errorf("%s is busy: %s", dir, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// IsMounted reports whether something is mounted on path. It consults the
+// mount table rather than comparing the device of path with its parent's:
+// stat on a mount whose server stopped answering blocks, and this is how
+// such mounts are found. On Linux the table is read from
+// /proc/self/mountinfo, without running mount(8).
+func IsMounted(path string) bool {
+	if runtime.GOOS == "linux" {
+		if table, err := os.ReadFile("/proc/self/mountinfo"); err == nil {
+			return mountinfoHas(string(table), path)
+		}
+	}
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(out), " on "+path+" ")
+}
+
+// mountPointEscaper escapes a path the way mountinfo prints mount points.
+var mountPointEscaper = strings.NewReplacer(`\`, `\134`, " ", `\040`, "\t", `\011`, "\n", `\012`)
+
+// mountinfoHas reports whether a mount on path is listed in table, whose
+// fifth field is the mount point.
+func mountinfoHas(table, path string) bool {
+	want := mountPointEscaper.Replace(path)
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && fields[4] == want {
+			return true
+		}
+	}
+	return false
+}
+
+// trackedListener remembers the connections it accepted, so closing it
+// also ends the NFS sessions on them instead of leaving them served by a
+// backend that is gone.
+type trackedListener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newTrackedListener(l net.Listener) *trackedListener {
+	return &trackedListener{Listener: l, conns: make(map[net.Conn]struct{})}
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	l.conns[c] = struct{}{}
+	return &trackedConn{Conn: c, l: l}, nil
+}
+
+func (l *trackedListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	for c := range l.conns {
+		c.Close()
+	}
+	return l.Listener.Close()
+}
+
+type trackedConn struct {
+	net.Conn
+	l *trackedListener
+}
+
+func (c *trackedConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c.Conn)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
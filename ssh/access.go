@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// remoteIdentity is who the SSH login runs as on the server.
+type remoteIdentity struct {
+	uid  uint32
+	gids map[uint32]bool
+}
+
+// EnableEffectivePerms makes the owner permission bits of every file show
+// what the SSH login user may actually do with it on the server.
+//
+// NFS clients answer ACCESS and decide up front whether to try an
+// operation from the mode bits and the owner, and every file is reported
+// as owned by the local user. Without this a file owned by someone else
+// looks writable and the write only fails later, at the server. Root
+// logins are left alone, since root may do everything anyway and rewriting
+// bits could leak into a later chmod.
+func (fs *SSHFS) EnableEffectivePerms() error {
+	id, err := fs.lookupIdentity()
+	if err != nil {
+		return fmt.Errorf("effective permissions: %w", err)
+	}
+	if id.uid == 0 {
+		return nil
+	}
+	fs.identity = id
+	return nil
+}
+
+// lookupIdentity asks the remote shell for id -u and id -G, and without a
+// shell (sftp-only accounts) assumes the owner of the SFTP home directory.
+func (fs *SSHFS) lookupIdentity() (*remoteIdentity, error) {
+	var out bytes.Buffer
+	if code, err := fs.client.Run("id -u && id -G", &out, io.Discard); err == nil && code == 0 {
+		fields := strings.Fields(out.String())
+		if len(fields) >= 1 {
+			id := &remoteIdentity{gids: map[uint32]bool{}}
+			uid, err := strconv.ParseUint(fields[0], 10, 32)
+			if err == nil {
+				id.uid = uint32(uid)
+				for _, f := range fields[1:] {
+					if gid, err := strconv.ParseUint(f, 10, 32); err == nil {
+						id.gids[uint32(gid)] = true
+					}
+				}
+				return id, nil
+			}
+		}
+	}
+
+	home, err := fs.conn.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.conn.Stat(home)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := info.Sys().(*sftp.FileStat)
+	if !ok {
+		return nil, fmt.Errorf("no ownership in attributes of %s", home)
+	}
+	return &remoteIdentity{uid: st.UID, gids: map[uint32]bool{st.GID: true}}, nil
+}
+
+// effectivePerm returns the rwx bits the remote identity has on info, by
+// the owner, group or other bits as the server would pick them.
+func (id *remoteIdentity) effectivePerm(info os.FileInfo) (os.FileMode, bool) {
+	st, ok := info.Sys().(*sftp.FileStat)
+	if !ok {
+		return 0, false
+	}
+	mode := info.Mode()
+	var bits os.FileMode
+	switch {
+	case st.UID == id.uid:
+		bits = (mode >> 6) & 07
+	case id.gids[st.GID]:
+		bits = (mode >> 3) & 07
+	default:
+		bits = mode & 07
+	}
+	return bits, true
+}
@@ -1,29 +1,216 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math/rand/v2"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	DefaultInitialBackoff    = 2 * time.Second
+	DefaultMaxBackoff        = 10 * time.Second
+	DefaultKeepaliveInterval = 10 * time.Second
+	DefaultConnectTimeout    = 15 * time.Second
+)
+
+// Options tunes how an SSHClient connects and reconnects. Zero values
+// select the defaults.
+type Options struct {
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	KeepaliveInterval time.Duration
+
+	// KeepaliveCountMax is how many keepalives in a row may go unanswered
+	// before the connection is dropped, like ServerAliveCountMax; 1 by
+	// default.
+	KeepaliveCountMax int
+
+	// ConnectTimeout bounds establishing a connection, TCP and SSH
+	// handshake together, like ssh's ConnectTimeout.
+	ConnectTimeout time.Duration
+
+	// IdentityFile, when set, is the only key offered: ssh config keys and
+	// the agent are skipped, for servers with a low MaxAuthTries.
+	IdentityFile string
+
+	// IdentitiesOnly, like IdentitiesOnly yes in the ssh config, which
+	// also sets it, offers only the config's identity files: agent keys
+	// are used just for those of them held encrypted.
+	IdentitiesOnly bool
+
+	// SFTPServer, like sftp -s, names the SSH subsystem that serves SFTP
+	// instead of "sftp", or, when it contains a '/', the path of an
+	// sftp-server to run as a command.
+	SFTPServer string
+
+	// BackgroundReconnect starts reconnecting as soon as a keepalive
+	// fails, so the link is usually back before the next file operation
+	// needs it rather than being rebuilt on its critical path.
+	BackgroundReconnect bool
+}
+
 type SSHClient struct {
-	alias string
-	conn  *ssh.Client
-	mu    sync.Mutex
+	alias     string
+	opts      Options
+	conn      *ssh.Client
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// reconnecting is set while keepalive reconnects in the background,
+	// and onReconnect runs once it has, see Options.BackgroundReconnect.
+	reconnecting atomic.Bool
+	onReconnect  func()
 }
 
-func Connect(alias string) (*SSHClient, error) {
-	conn, err := getConn(alias)
+func Connect(alias string, opts Options) (*SSHClient, error) {
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.MaxBackoff < opts.InitialBackoff {
+		opts.MaxBackoff = opts.InitialBackoff
+	}
+	if opts.KeepaliveInterval <= 0 {
+		opts.KeepaliveInterval = DefaultKeepaliveInterval
+	}
+	if opts.KeepaliveCountMax <= 0 {
+		opts.KeepaliveCountMax = 1
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	conn, err := getConn(alias, opts)
 	if err != nil {
 		return nil, err
 	}
-	return &SSHClient{alias: alias, conn: conn}, nil
+	c := &SSHClient{alias: alias, opts: opts, conn: conn, done: make(chan struct{})}
+	go c.keepalive()
+	return c, nil
+}
+
+// keepalive pings the server every KeepaliveInterval. A failed ping, or
+// KeepaliveCountMax unanswered ones in a row, drops the connection, so
+// IsConnected reports a dead link within that many intervals instead of on
+// the next file operation.
+func (c *SSHClient) keepalive() {
+	ticker := time.NewTicker(c.opts.KeepaliveInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		conn := c.GetConn()
+		if conn == nil {
+			if c.opts.BackgroundReconnect {
+				c.reconnectInBackground()
+			}
+			continue
+		}
+		err := sendKeepalive(conn, c.opts.KeepaliveInterval)
+		if errors.Is(err, errNoReply) {
+			if missed++; missed < c.opts.KeepaliveCountMax {
+				Debugf("Keepalive to %s unanswered (%d of %d)", c.alias, missed, c.opts.KeepaliveCountMax)
+				continue
+			}
+		}
+		missed = 0
+		if err != nil {
+			Warnf("Keepalive to %s failed: %v", c.alias, err)
+			c.mu.Lock()
+			if c.conn == conn {
+				c.conn.Close()
+				c.conn = nil
+			}
+			c.mu.Unlock()
+			if c.opts.BackgroundReconnect {
+				c.reconnectInBackground()
+			}
+		}
+	}
+}
+
+// reconnectInBackground reconnects from the keepalive loop. File operations
+// arriving meanwhile wait in EnsureConnected for it instead of starting
+// over. If every attempt fails, the next tick tries again.
+func (c *SSHClient) reconnectInBackground() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.reconnecting.Store(true)
+	defer c.reconnecting.Store(false)
+	if err := c.EnsureConnected(); err != nil {
+		Warnf("Background reconnect to %s: %v", c.alias, err)
+		return
+	}
+	if c.onReconnect != nil {
+		c.onReconnect()
+	}
+}
+
+// Reconnecting reports whether the client is reconnecting in the
+// background, see Options.BackgroundReconnect.
+func (c *SSHClient) Reconnecting() bool {
+	return c.reconnecting.Load()
+}
+
+var errNoReply = errors.New("no reply")
+
+func sendKeepalive(conn *ssh.Client, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w in %v", errNoReply, timeout)
+	}
+}
+
+func (c *SSHClient) Options() Options {
+	return c.opts
+}
+
+// Backoff returns the wait before reconnect attempt i (zero-based): the
+// initial backoff doubled per attempt, capped at the max backoff, less up
+// to 20% jitter so that several mounts don't retry in lockstep.
+func (c *SSHClient) Backoff(i int) time.Duration {
+	d := c.opts.InitialBackoff
+	for range i {
+		d *= 2
+		if d >= c.opts.MaxBackoff {
+			d = c.opts.MaxBackoff
+			break
+		}
+	}
+	if jitter := int64(d / 5); jitter > 0 {
+		d -= time.Duration(rand.Int64N(jitter))
+	}
+	return d
 }
 
 func (c *SSHClient) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.conn != nil {
@@ -32,6 +219,53 @@ func (c *SSHClient) Close() error {
 	return nil
 }
 
+// NewSFTP starts an SFTP client over the connection, on the subsystem or
+// server command chosen with Options.SFTPServer.
+func (c *SSHClient) NewSFTP() (*sftp.Client, error) {
+	conn := c.GetConn()
+	if conn == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+	server := c.opts.SFTPServer
+	if server == "" || server == "sftp" {
+		return sftp.NewClient(conn)
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if strings.Contains(server, "/") {
+		err = session.Start(server)
+	} else {
+		err = session.RequestSubsystem(server)
+	}
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("start sftp server %q: %w", server, err)
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	go func() {
+		client.Wait()
+		session.Close()
+	}()
+	return client, nil
+}
+
 func (c *SSHClient) NewSession() (*ssh.Session, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -41,26 +275,84 @@ func (c *SSHClient) NewSession() (*ssh.Session, error) {
 	return nil, fmt.Errorf("not connected")
 }
 
+// ShellCwd returns the directory a login shell on the remote lands in,
+// which can differ from the SFTP server's getwd when shell rc files cd.
+func (c *SSHClient) ShellCwd() (string, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	out, err := session.Output(`"${SHELL:-sh}" -lc pwd`)
+	if err != nil {
+		return "", fmt.Errorf("login shell pwd: %w", err)
+	}
+	// rc files may print banners; pwd's answer is the last line.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	cwd := strings.TrimSpace(lines[len(lines)-1])
+	if !strings.HasPrefix(cwd, "/") {
+		return "", fmt.Errorf("login shell pwd: unexpected output %q", cwd)
+	}
+	return cwd, nil
+}
+
+// Run runs command on the remote host in a new session on the existing
+// connection, copying its output to stdout and stderr. It returns the
+// command's exit status; err is set only when the command could not be run
+// or finish normally.
+func (c *SSHClient) Run(command string, stdout, stderr io.Writer) (int, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Run(command)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
 func (c *SSHClient) reconnect() error {
-	log.Printf("Attempting to reconnect to %s...", c.alias)
+	Infof("Attempting to reconnect to %s...", c.alias)
 
 	for i := range 5 {
-		conn, err := getConn(c.alias)
+		conn, err := getConn(c.alias, c.opts)
 		if err == nil {
 			c.conn = conn
-			log.Printf("Reconnected to %s successfully", c.alias)
+			Infof("Reconnected to %s successfully", c.alias)
 			return nil
 		}
 
-		log.Printf("Reconnection attempt %d failed: %v", i+1, err)
-		waitTime := time.Duration(i+1) * 2 * time.Second
-		log.Printf("Waiting %v before retry...", waitTime)
+		Warnf("Reconnection attempt %d failed: %v", i+1, err)
+		waitTime := c.Backoff(i)
+		Debugf("Waiting %v before retry...", waitTime)
 		time.Sleep(waitTime)
 	}
 
 	return fmt.Errorf("failed to reconnect after 5 attempts")
 }
 
+// Reconnect drops the connection, whether or not it still seems alive,
+// and dials again.
+func (c *SSHClient) Reconnect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return c.reconnectNoLock()
+}
+
 func (c *SSHClient) EnsureConnected() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -73,19 +365,19 @@ func (c *SSHClient) EnsureConnected() error {
 }
 
 func (c *SSHClient) reconnectNoLock() error {
-	log.Printf("Attempting to reconnect to %s...", c.alias)
+	Infof("Attempting to reconnect to %s...", c.alias)
 
 	for i := range 5 {
-		conn, err := getConn(c.alias)
+		conn, err := getConn(c.alias, c.opts)
 		if err == nil {
 			c.conn = conn
-			log.Printf("Reconnected to %s successfully", c.alias)
+			Infof("Reconnected to %s successfully", c.alias)
 			return nil
 		}
 
-		log.Printf("Reconnection attempt %d failed: %v", i+1, err)
-		waitTime := time.Duration(i+1) * 2 * time.Second
-		log.Printf("Waiting %v before retry...", waitTime)
+		Warnf("Reconnection attempt %d failed: %v", i+1, err)
+		waitTime := c.Backoff(i)
+		Debugf("Waiting %v before retry...", waitTime)
 		time.Sleep(waitTime)
 	}
 
@@ -0,0 +1,33 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	c := &SSHClient{opts: Options{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	want := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for i, d := range want {
+		for range 100 {
+			got := c.Backoff(i)
+			if got > d || got <= d-d/5 {
+				t.Fatalf("Backoff(%d) = %v, want within 20%% below %v", i, got, d)
+			}
+		}
+	}
+}
+
+func TestBackoffLargeAttempt(t *testing.T) {
+	c := &SSHClient{opts: Options{InitialBackoff: time.Second, MaxBackoff: time.Minute}}
+	if got := c.Backoff(1000); got > time.Minute || got <= time.Minute-time.Minute/5 {
+		t.Fatalf("Backoff(1000) = %v, want capped at %v", got, time.Minute)
+	}
+}
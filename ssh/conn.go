@@ -1,13 +1,19 @@
 package ssh
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	osuser "os/user"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -19,17 +25,69 @@ type sshConfig struct {
 	hostname string
 	port     string
 	signers  []ssh.Signer
-	agent    string
+	agents   []string // agent sockets, see agentSockets
+
+	keys    []string // identity files that loaded
+	keyErrs []string // identity files that didn't, and why
+
+	// identitiesOnly is IdentitiesOnly from the config, and identityKeys
+	// the public keys of its identity files, encrypted ones included, which
+	// are then all that agents may offer.
+	identitiesOnly bool
+	identityKeys   []ssh.PublicKey
 }
 
+// splitTarget splits a target given as [user@]host[:port], where host may
+// be an ssh config alias or a bracketed IPv6 literal.
+func splitTarget(target string) (user, host, port string) {
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		user, target = target[:i], target[i+1:]
+	}
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		return user, h, p
+	}
+	return user, strings.TrimSuffix(strings.TrimPrefix(target, "["), "]"), ""
+}
+
+// getConfig resolves alias, an ssh config alias or a direct
+// [user@]host[:port] target, with ssh -G. Without an ssh binary it falls
+// back to what ssh would use with no config: the local user, port 22 and
+// the default key files.
 func getConfig(alias string) (c sshConfig, err error) {
-	c.agent = os.Getenv("SSH_AUTH_SOCK")
+	user, host, port := splitTarget(alias)
+	if host == "" {
+		return c, fmt.Errorf("no host in %q", alias)
+	}
+	args := []string{"-G"}
+	if user != "" {
+		args = append(args, "-l", user)
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", host)
+
+	out, err := exec.Command("ssh", args...).Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		Debugf("ssh not found, using defaults for %s", alias)
+		out, err = defaultConfig(user, host, port), nil
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		return c, fmt.Errorf("ssh -G %s: %s", alias, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	var identityAgent string
+	c, identityAgent = parseConfig(string(out))
+	c.agents = agentSockets(identityAgent)
 
-	var keys []string
-	var keyErrs []string
+	Debugf("Parsed config for %v: %v@%v:%v, found identity agents [%v] and keys [%v], errors: [%v]",
+		alias, c.user, c.hostname, c.port, strings.Join(c.agents, ", "), strings.Join(c.keys, ", "), strings.Join(c.keyErrs, "; "))
 
-	out, err := exec.Command("ssh", "-G", alias).Output()
-	for _, line := range strings.Split(string(out), "\n") {
+	return c, err
+}
+
+// parseConfig reads the output of ssh -G, loading the identity files it
+// names, and returns the IdentityAgent setting alongside.
+func parseConfig(out string) (c sshConfig, identityAgent string) {
+	for _, line := range strings.Split(out, "\n") {
 		key, value, ok := strings.Cut(line, " ")
 		if !ok {
 			continue
@@ -37,51 +95,200 @@ func getConfig(alias string) (c sshConfig, err error) {
 		if key == "user" {
 			c.user = value
 		} else if key == "hostname" {
-			c.hostname = value
+			// IPv6 literals may come bracketed; JoinHostPort adds its own.
+			c.hostname = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
 		} else if key == "port" {
 			c.port = value
 		} else if key == "identityfile" {
 			path, err := normalizePath(value)
 			if err != nil {
-				keyErrs = append(keyErrs, fmt.Sprintf("%v: failed to normalize: %v", value, err))
+				c.keyErrs = append(c.keyErrs, fmt.Sprintf("%v: failed to normalize: %v", value, err))
 				continue
 			}
 			key, err := os.ReadFile(path)
 			if err != nil {
-				keyErrs = append(keyErrs, fmt.Sprintf("%v: failed to read: %v", value, err))
+				c.keyErrs = append(c.keyErrs, fmt.Sprintf("%v: failed to read: %v", value, err))
 				continue
 			}
 			signer, err := ssh.ParsePrivateKey(key)
 			if err != nil {
-				keyErrs = append(keyErrs, fmt.Sprintf("%v: failed to parse: %v", value, err))
+				if pub := identityPublicKey(path, err); pub != nil {
+					c.identityKeys = append(c.identityKeys, pub)
+				}
+				c.keyErrs = append(c.keyErrs, fmt.Sprintf("%v: failed to parse: %v", value, err))
 				continue
 			}
-			keys = append(keys, value)
+			c.keys = append(c.keys, value)
 			c.signers = append(c.signers, signer)
+			c.identityKeys = append(c.identityKeys, signer.PublicKey())
 		} else if key == "identityagent" {
-			c.agent = value
+			identityAgent = value
+		} else if key == "identitiesonly" {
+			c.identitiesOnly = value == "yes"
 		}
 	}
+	return c, identityAgent
+}
 
-	log.Printf("Parsed confing for %v: %v@%v:%v, found identity agent %v and keys [%v], errors: [%v]",
-		alias, c.user, c.hostname, c.port, c.agent, strings.Join(keys, ", "), strings.Join(keyErrs, "; "))
+// identityPublicKey is the public half of the identity file at path that
+// failed to parse with err: from the key itself when only its passphrase
+// is missing, else from path.pub. It is nil when neither has it.
+func identityPublicKey(path string, err error) ssh.PublicKey {
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && missing.PublicKey != nil {
+		return missing.PublicKey
+	}
+	data, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
 
-	return c, err
+// defaultConfig is ssh -G output for a host without any ssh config. Key
+// files that do not exist are skipped quietly.
+func defaultConfig(user, host, port string) []byte {
+	if user == "" {
+		if u, err := osuser.Current(); err == nil {
+			user = u.Username
+		}
+	}
+	if port == "" {
+		port = "22"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "user %s\nhostname %s\nport %s\n", user, host, port)
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if p := filepath.Join(home, ".ssh", name); fileExists(p) {
+				fmt.Fprintf(&b, "identityfile %s\n", p)
+			}
+		}
+	}
+	return []byte(b.String())
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// HostConfig is what ssh -G resolved for an alias, as used to connect.
+type HostConfig struct {
+	User           string
+	Hostname       string
+	Port           string
+	IdentityAgents []string
+	IdentityFiles  []string
+	IdentitiesOnly bool
+	KeyErrors      []string
 }
 
-func getAgentSigners(sock string) ([]ssh.Signer, error) {
+// LookupConfig resolves alias the same way Connect does, without
+// connecting.
+func LookupConfig(alias string) (HostConfig, error) {
+	c, err := getConfig(alias)
+	return HostConfig{
+		User:           c.user,
+		Hostname:       c.hostname,
+		Port:           c.port,
+		IdentityAgents: c.agents,
+		IdentityFiles:  c.keys,
+		IdentitiesOnly: c.identitiesOnly,
+		KeyErrors:      c.keyErrs,
+	}, err
+}
+
+// agentSockets lists the agents whose keys are offered: the IdentityAgent
+// of the ssh config, then $SSH_AUTH_SOCK, which may be a forwarded agent,
+// then any in $RFS_IDENTITY_AGENTS, a list like $PATH, for agents such as
+// 1Password or Secretive that have a socket of their own. IdentityAgent
+// none leaves out the first two, as it does for ssh.
+func agentSockets(identityAgent string) []string {
+	var socks []string
+	add := func(sock string) {
+		sock, err := normalizePath(os.ExpandEnv(sock))
+		if err == nil && sock != "" && !slices.Contains(socks, sock) {
+			socks = append(socks, sock)
+		}
+	}
+	if identityAgent != "none" {
+		if identityAgent != "SSH_AUTH_SOCK" {
+			add(identityAgent)
+		}
+		add(os.Getenv("SSH_AUTH_SOCK"))
+	}
+	for _, sock := range filepath.SplitList(os.Getenv("RFS_IDENTITY_AGENTS")) {
+		add(sock)
+	}
+	return socks
+}
+
+// getAgentSigners returns the keys of the agent at sock. The signers use
+// the returned connection, which must stay open until authentication is
+// done.
+func getAgentSigners(sock string) ([]ssh.Signer, io.Closer, error) {
 	conn, err := net.Dial("unix", sock)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
-	defer conn.Close()
+	return signers, conn, nil
+}
+
+// appendSigners appends those of more whose public key is not in signers
+// yet, so a key held by several agents, or also in a file, is offered once.
+func appendSigners(signers []ssh.Signer, more ...ssh.Signer) []ssh.Signer {
+	for _, s := range more {
+		key := s.PublicKey().Marshal()
+		if !slices.ContainsFunc(signers, func(have ssh.Signer) bool {
+			return bytes.Equal(have.PublicKey().Marshal(), key)
+		}) {
+			signers = append(signers, s)
+		}
+	}
+	return signers
+}
 
-	agentClient := agent.NewClient(conn)
-	signers, err := agentClient.Signers()
+// onlyIdentities keeps those of signers whose public key is in keys, as
+// ssh does with agent keys under IdentitiesOnly.
+func onlyIdentities(signers []ssh.Signer, keys []ssh.PublicKey) []ssh.Signer {
+	var kept []ssh.Signer
+	for _, s := range signers {
+		key := s.PublicKey().Marshal()
+		if slices.ContainsFunc(keys, func(k ssh.PublicKey) bool {
+			return bytes.Equal(k.Marshal(), key)
+		}) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// loadKey reads and parses the private key at path. Encrypted keys are
+// not supported; load them into the agent instead.
+func loadKey(path string) (ssh.Signer, error) {
+	path, err := normalizePath(path)
 	if err != nil {
 		return nil, err
 	}
-	return signers, nil
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("identity file: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("identity file %s: %w", path, err)
+	}
+	return signer, nil
 }
 
 func normalizePath(path string) (string, error) {
@@ -93,44 +300,153 @@ func normalizePath(path string) (string, error) {
 	return path, err
 }
 
-func getConn(alias string) (*ssh.Client, error) {
+func getConn(alias string, opts Options) (*ssh.Client, error) {
 	aliasConfig, err := getConfig(alias)
 	if err != nil {
-		log.Fatalf("Failed to find config for alias %v", alias)
+		return nil, err
 	}
 
-	agentConn, err := net.Dial("unix", aliasConfig.agent)
-	var agentSigners []ssh.Signer
-
-	if err != nil {
-		log.Printf("Failed to dial agent: %v", err)
-		agentSigners = []ssh.Signer{}
-	} else {
-		defer agentConn.Close()
-		agentClient := agent.NewClient(agentConn)
-		agentSigners, err = agentClient.Signers()
+	var signers []ssh.Signer
+	if opts.IdentityFile != "" {
+		signer, err := loadKey(opts.IdentityFile)
 		if err != nil {
-			log.Printf("Failed to get agent signers: %v", err)
+			return nil, err
+		}
+		signers = []ssh.Signer{signer}
+	} else {
+		signers = appendSigners(nil, aliasConfig.signers...)
+		for _, sock := range aliasConfig.agents {
+			agentSigners, conn, err := getAgentSigners(sock)
+			if err != nil {
+				Warnf("Failed to use agent %s: %v", sock, err)
+				continue
+			}
+			defer conn.Close()
+			if opts.IdentitiesOnly || aliasConfig.identitiesOnly {
+				agentSigners = onlyIdentities(agentSigners, aliasConfig.identityKeys)
+			}
+			signers = appendSigners(signers, agentSigners...)
 		}
 	}
 
-	signers := append(aliasConfig.signers, agentSigners...)
-
 	knownHostsPath := os.ExpandEnv("$HOME/.ssh/known_hosts")
 	hostKeyCallback, err := knownhosts.New(knownHostsPath)
 	if err != nil {
-		log.Fatalf("Warning: failed to load known_hosts %v: %v", knownHostsPath, err)
+		return nil, fmt.Errorf("load known_hosts: %w", err)
 	}
 
+	var offered ssh.PublicKey
 	config := &ssh.ClientConfig{
 		User: aliasConfig.user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signers...),
 		},
-		HostKeyCallback: hostKeyCallback,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			offered = key
+			return hostKeyCallback(hostname, remote, key)
+		},
+		Timeout: opts.ConnectTimeout,
 	}
 
 	addr := net.JoinHostPort(aliasConfig.hostname, aliasConfig.port)
-	client, err := ssh.Dial("tcp", addr, config)
+	client, err := dial(addr, config)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+		return nil, &HostKeyChangedError{Host: addr, Offered: offered, Want: keyErr.Want}
+	}
 	return client, err
 }
+
+// dial connects to addr like ssh.Dial, but bounds the TCP connect and the
+// SSH handshake together by config.Timeout, so a host that is down or
+// never answers fails quickly rather than after the system's TCP timeout.
+func dial(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if config.Timeout <= 0 {
+		return ssh.Dial("tcp", addr, config)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("connect to %s: connection timed out after %v", addr, config.Timeout)
+		}
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("connect to %s: SSH handshake timed out after %v", addr, config.Timeout)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// HostKeyChangedError reports that the server presented a key that differs
+// from the one recorded in known_hosts, which may mean a MITM attack.
+type HostKeyChangedError struct {
+	Host    string
+	Offered ssh.PublicKey
+	Want    []knownhosts.KnownKey
+}
+
+func (e *HostKeyChangedError) Error() string {
+	var b strings.Builder
+	b.WriteString("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+	b.WriteString("@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @\n")
+	b.WriteString("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+	b.WriteString("IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!\n")
+	fmt.Fprintf(&b, "The host key presented by %s does not match known_hosts.\n", e.Host)
+	if e.Offered != nil {
+		fmt.Fprintf(&b, "Offered %s key: %s\n", e.Offered.Type(), ssh.FingerprintSHA256(e.Offered))
+	}
+	for _, k := range e.Want {
+		fmt.Fprintf(&b, "Offending key in %s:%d (%s)\n", k.Filename, k.Line, ssh.FingerprintSHA256(k.Key))
+	}
+	b.WriteString("Refusing to connect.")
+	return b.String()
+}
+
+// WaitForNetwork blocks until the host behind alias resolves and accepts a
+// TCP connection on its SSH port, or until timeout elapses.
+func WaitForNetwork(alias string, timeout time.Duration) error {
+	aliasConfig, err := getConfig(alias)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(aliasConfig.hostname, aliasConfig.port)
+	var dialer net.Dialer
+	return waitForAddr(dialer.DialContext, addr, timeout, time.Second)
+}
+
+// waitForAddr dials addr every poll until it answers. Each dial gives up
+// after 5s, and none runs past timeout.
+func waitForAddr(dial func(ctx context.Context, network, addr string) (net.Conn, error), addr string, timeout, poll time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		dialCtx, cancelDial := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := dial(dialCtx, "tcp", addr)
+		cancelDial()
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("network not ready: %s unreachable after %v: %w", addr, timeout, err)
+		}
+		Infof("Waiting for network, %s unreachable: %v", addr, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("network not ready: %s unreachable after %v: %w", addr, timeout, err)
+		case <-time.After(poll):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseConfigIPv6(t *testing.T) {
+	for _, hostname := range []string{"[2001:db8::1]", "2001:db8::1"} {
+		c, _ := parseConfig("user alice\nhostname " + hostname + "\nport 2222\n")
+		if c.hostname != "2001:db8::1" {
+			t.Errorf("hostname %s: parsed %q, want 2001:db8::1", hostname, c.hostname)
+		}
+		if got := net.JoinHostPort(c.hostname, c.port); got != "[2001:db8::1]:2222" {
+			t.Errorf("hostname %s: dials %s, want [2001:db8::1]:2222", hostname, got)
+		}
+	}
+}
+
+func TestSplitTarget(t *testing.T) {
+	tests := []struct {
+		target, user, host, port string
+	}{
+		{"alias", "", "alias", ""},
+		{"alice@host", "alice", "host", ""},
+		{"host:2222", "", "host", "2222"},
+		{"alice@host:2222", "alice", "host", "2222"},
+		{"[2001:db8::1]", "", "2001:db8::1", ""},
+		{"alice@[2001:db8::1]:2222", "alice", "2001:db8::1", "2222"},
+	}
+	for _, tt := range tests {
+		user, host, port := splitTarget(tt.target)
+		if user != tt.user || host != tt.host || port != tt.port {
+			t.Errorf("splitTarget(%q) = %q, %q, %q; want %q, %q, %q", tt.target, user, host, port, tt.user, tt.host, tt.port)
+		}
+	}
+}
+
+func TestWaitForAddrBecomesReachable(t *testing.T) {
+	start := time.Now()
+	dials := 0
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		if time.Since(start) < 50*time.Millisecond {
+			return nil, syscall.ECONNREFUSED
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	if err := waitForAddr(dial, "host:22", time.Second, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if dials < 2 {
+		t.Fatalf("dialed %d times, want retries until reachable", dials)
+	}
+}
+
+func TestWaitForAddrTimeout(t *testing.T) {
+	// A dial that hangs must not run past the timeout.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	err := waitForAddr(dial, "host:22", 100*time.Millisecond, 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %v with a 100ms timeout", elapsed)
+	}
+}
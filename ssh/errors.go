@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTP status codes beyond the v3 set that pkg/sftp normalises itself, and
+// the v3 catch-all failure.
+const (
+	fxFailure             = 4
+	fxFileAlreadyExists   = 11
+	fxWriteProtect        = 12
+	fxNoSpaceOnFilesystem = 14
+	fxQuotaExceeded       = 15
+	fxDirNotEmpty         = 18
+	fxNotADirectory       = 19
+	fxFileIsADirectory    = 24
+)
+
+// toErrno converts SFTP server status errors into syscall errnos wrapped in
+// an *os.PathError, so logs and the WebDAV frontend see ENOSPC, EROFS and
+// friends instead of a generic failure. Other errors are returned unchanged.
+// It does not reach NFS clients: libnfs-go answers every failed WRITE,
+// CREATE, SETATTR and REMOVE with NFS4ERR_PERM whatever the error, so the
+// kernel still reports EPERM.
+func toErrno(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var errno syscall.Errno
+	var status *sftp.StatusError
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		errno = syscall.EACCES
+	case errors.As(err, &status):
+		switch status.Code {
+		case fxFileAlreadyExists:
+			errno = syscall.EEXIST
+		case fxWriteProtect:
+			errno = syscall.EROFS
+		case fxNoSpaceOnFilesystem:
+			errno = syscall.ENOSPC
+		case fxQuotaExceeded:
+			errno = syscall.EDQUOT
+		case fxDirNotEmpty:
+			errno = syscall.ENOTEMPTY
+		case fxNotADirectory:
+			errno = syscall.ENOTDIR
+		case fxFileIsADirectory:
+			errno = syscall.EISDIR
+		default:
+			return err
+		}
+	default:
+		return err
+	}
+	return &os.PathError{Op: op, Path: path, Err: errno}
+}
+
+// isRetryable reports whether err is a connection-level failure worth
+// retrying: the SFTP session is gone or the transport broke. Anything else,
+// an answer from the server (ENOENT, EACCES, a mapped errno) or an error
+// it doesn't recognise, is not retried, since a retry would repeat it or,
+// for an operation that went through, fail where it had succeeded.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) || errors.Is(err, os.ErrPermission) {
+		return false
+	}
+	if errors.Is(err, sftp.ErrSSHFxNoConnection) || errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		return true
+	}
+	// A reset connection is a net.OpError around ECONNRESET; any other
+	// errno is the server's answer, and errnos pass for net.Errors too.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
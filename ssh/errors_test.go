@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestToErrno(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"exists", &sftp.StatusError{Code: fxFileAlreadyExists}, syscall.EEXIST},
+		{"read-only", &sftp.StatusError{Code: fxWriteProtect}, syscall.EROFS},
+		{"no space", &sftp.StatusError{Code: fxNoSpaceOnFilesystem}, syscall.ENOSPC},
+		{"quota", &sftp.StatusError{Code: fxQuotaExceeded}, syscall.EDQUOT},
+		{"not empty", &sftp.StatusError{Code: fxDirNotEmpty}, syscall.ENOTEMPTY},
+		{"not a directory", &sftp.StatusError{Code: fxNotADirectory}, syscall.ENOTDIR},
+		{"is a directory", &sftp.StatusError{Code: fxFileIsADirectory}, syscall.EISDIR},
+		{"permission", os.ErrPermission, syscall.EACCES},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := toErrno("write", "/f", tt.err)
+			var pathErr *os.PathError
+			if !errors.As(err, &pathErr) || pathErr.Op != "write" || pathErr.Path != "/f" {
+				t.Fatalf("toErrno = %#v, want an *os.PathError for write /f", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("toErrno = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestToErrnoPassesThrough(t *testing.T) {
+	failure := &sftp.StatusError{Code: fxFailure}
+	for _, err := range []error{nil, os.ErrNotExist, failure} {
+		if got := toErrno("write", "/f", err); got != err {
+			t.Errorf("toErrno(%v) = %v, want it unchanged", err, got)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection lost", sftp.ErrSSHFxConnectionLost, true},
+		{"no connection", sftp.ErrSSHFxNoConnection, true},
+		{"wrapped connection lost", fmt.Errorf("timed out: %w", sftp.ErrSSHFxConnectionLost), true},
+		{"eof", io.EOF, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"net error", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{"not exist", os.ErrNotExist, false},
+		{"permission", &os.PathError{Op: "open", Path: "/f", Err: syscall.EACCES}, false},
+		{"exists", os.ErrExist, false},
+		{"mapped errno", toErrno("write", "/f", &sftp.StatusError{Code: fxNoSpaceOnFilesystem}), false},
+		{"status", &sftp.StatusError{Code: fxFailure}, false},
+		{"unknown", errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
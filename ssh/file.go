@@ -1,6 +1,8 @@
 package ssh
 
 import (
+	"io"
+	"os"
 	"path"
 	"strings"
 
@@ -15,22 +17,137 @@ type file struct {
 	isDir    bool
 	fullPath string
 	rootDir  string
+
+	// cached is set when handle is shared through the handle cache. Reads
+	// then go through ReadAt at offset so readers don't move each other.
+	cached *cachedHandle
+	offset int64
+
+	// eof is the file size as far as this handle knows, once eofKnown, and
+	// holeEnd the size skipped zero writes give it, see skipHole.
+	eof      int64
+	eofKnown bool
+	holeEnd  int64
+	written  bool
+
+	// append is set for O_APPEND handles, whose every write goes to the
+	// current end of the file whatever the offset.
+	append bool
+
+	// dirEntries holds the listing loaded by the first Readdir call and
+	// dirPos is how many of them have been returned so far. Neither
+	// frontend pages through it: libnfs-go opens the directory afresh and
+	// calls Readdir(-1) for every READDIR, slicing by cookie itself, and
+	// WebDAV asks for everything too. The whole listing is still fetched
+	// per request over NFS; the cursor only serves callers asking for n > 0.
+	dirEntries []os.FileInfo
+	dirPos     int
 }
 
 func (f *file) Close() error {
-	return f.handle.Close()
+	if f.cached != nil {
+		f.fs.handles.release(f.cached)
+		return nil
+	}
+	holeErr := f.fillHole()
+	if f.written {
+		f.fs.handles.invalidate(f.fullPath)
+	}
+	if err := f.handle.Close(); err != nil {
+		return err
+	}
+	return holeErr
 }
 
+// Read fills p unless the file ends first. A short read is therefore only
+// returned at EOF, with a nil error; the following call returns 0, io.EOF.
 func (f *file) Read(p []byte) (n int, err error) {
-	return f.handle.Read(p)
+	f.fs.touch()
+	for n < len(p) {
+		var m int
+		err = f.fs.withTimeout(f.client, func() (err error) {
+			if f.cached != nil {
+				m, err = f.readAt(p[n:], f.offset)
+				f.offset += int64(m)
+			} else {
+				m, err = f.handle.Read(p[n:])
+			}
+			return err
+		})
+		n += m
+		if err != nil {
+			break
+		}
+		if m == 0 {
+			err = io.ErrNoProgress
+			break
+		}
+	}
+	f.fs.counters.bytesRead.Add(int64(n))
+	f.fs.limiter.wait(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
 }
 
+// Write loops until all of p is written or the server reports an error, so
+// a short write never goes unnoticed.
 func (f *file) Write(p []byte) (n int, err error) {
-	return f.handle.Write(p)
+	if err := f.fs.writable("write", f.fullPath); err != nil {
+		return 0, err
+	}
+	f.fs.touch()
+	if f.append {
+		// The server may ignore the append flag, and others may have
+		// written since, so find the end again.
+		if _, err := f.handle.Seek(0, io.SeekEnd); err != nil {
+			return 0, toErrno("write", f.fullPath, err)
+		}
+	} else if f.skipHole(p) {
+		return len(p), nil
+	}
+	f.fs.limiter.wait(len(p))
+	for n < len(p) {
+		var m int
+		err = f.fs.withTimeout(f.client, func() (err error) {
+			m, err = f.handle.Write(p[n:])
+			return err
+		})
+		n += m
+		if err != nil {
+			break
+		}
+		if m == 0 {
+			err = io.ErrShortWrite
+			break
+		}
+	}
+	f.fs.counters.bytesWritten.Add(int64(n))
+	f.written = true
+	f.wrote()
+	return n, toErrno("write", f.fullPath, err)
 }
 
 func (f *file) Seek(offset int64, whence int) (int64, error) {
-	return f.handle.Seek(offset, whence)
+	if f.cached == nil {
+		return f.handle.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		info, err := f.handle.Stat()
+		if err != nil {
+			return f.offset, err
+		}
+		offset += info.Size()
+	}
+	if offset < 0 {
+		return f.offset, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
 }
 
 func (f *file) Name() string {
@@ -38,12 +155,15 @@ func (f *file) Name() string {
 }
 
 func (f *file) Stat() (nfsFs.FileInfo, error) {
+	if err := f.fillHole(); err != nil {
+		return nil, err
+	}
 	info, err := f.handle.Stat()
 	if err != nil {
 		return nil, err
 	}
 	nfsPath := f.fullPath
-	if f.rootDir != "" && strings.HasPrefix(f.fullPath, f.rootDir) {
+	if f.rootDir != "" && hasPathPrefix(f.fullPath, path.Clean(f.rootDir)) {
 		rel := strings.TrimPrefix(f.fullPath, f.rootDir)
 		if rel == "" {
 			nfsPath = "/"
@@ -51,10 +171,16 @@ func (f *file) Stat() (nfsFs.FileInfo, error) {
 			nfsPath = rel
 		}
 	}
-	return newFileInfoWithPath(info, nfsPath, f.rootDir), nil
+	return f.fs.annotate(newFileInfoWithPath(info, nfsPath, f.rootDir), f.fullPath), nil
 }
 
 func (f *file) Truncate() error {
+	if err := f.fs.writable("truncate", f.fullPath); err != nil {
+		return err
+	}
+	if err := f.fillHole(); err != nil {
+		return err
+	}
 	info, err := f.handle.Stat()
 	if err != nil {
 		return err
@@ -62,11 +188,25 @@ func (f *file) Truncate() error {
 	return f.handle.Truncate(info.Size())
 }
 
+// Sync asks the server to flush the file to stable storage. Writes are not
+// buffered here, so they have all been sent by the time Sync runs. Without
+// the fsync@openssh.com extension there is nothing to ask for; that is
+// logged once per mount rather than failing every fsync.
 func (f *file) Sync() error {
+	if err := f.fillHole(); err != nil {
+		return err
+	}
+	if _, ok := f.client.HasExtension("fsync@openssh.com"); !ok {
+		f.fs.noFsyncWarning.Do(func() {
+			Warnf("Server lacks fsync@openssh.com, fsync is a no-op and durability is not guaranteed")
+		})
+		return nil
+	}
 	return f.handle.Sync()
 }
 
 func (f *file) Readdir(n int) ([]nfsFs.FileInfo, error) {
+	f.fs.touch()
 	if !f.isDir {
 		return nil, nil
 	}
@@ -76,30 +216,58 @@ func (f *file) Readdir(n int) ([]nfsFs.FileInfo, error) {
 		dirPath = f.handle.Name()
 	}
 
-	if entries, ok := f.fs.getDirCache(dirPath); ok {
-		result := make([]nfsFs.FileInfo, len(entries))
-		for i, entry := range entries {
-			entryPath := path.Join(dirPath, entry.Name())
-			result[i] = newFileInfoWithPath(entry, entryPath, f.rootDir)
+	if f.dirEntries == nil {
+		entries, err := f.loadDir(dirPath)
+		if err != nil {
+			return nil, err
 		}
-		return result, nil
+		f.dirEntries = entries
+		f.dirPos = 0
+	}
+
+	remaining := f.dirEntries[f.dirPos:]
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		if len(remaining) > n {
+			remaining = remaining[:n]
+		}
+	}
+	f.dirPos += len(remaining)
+
+	result := make([]nfsFs.FileInfo, len(remaining))
+	for i, entry := range remaining {
+		entryPath := path.Join(dirPath, entry.Name())
+		result[i] = f.fs.annotate(newFileInfoWithPath(entry, entryPath, f.rootDir), entryPath)
+	}
+	return result, nil
+}
+
+func (f *file) loadDir(dirPath string) ([]os.FileInfo, error) {
+	if entries, ok := f.fs.getDirCache(dirPath); ok {
+		return entries, nil
 	}
 
 	if err := f.fs.ensureConnected(); err != nil {
 		return nil, err
 	}
 
-	entries, err := f.fs.conn.ReadDir(dirPath)
+	f.fs.counters.readDirs.Add(1)
+	var entries []os.FileInfo
+	conn := f.fs.conn
+	err := f.fs.withTimeout(conn, func() (err error) {
+		entries, err = conn.ReadDir(dirPath)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	entries = f.fs.followLinks(dirPath, f.fs.filterIgnored(entries))
+	if entries == nil {
+		entries = []os.FileInfo{}
+	}
 
 	f.fs.setDirCache(dirPath, entries)
-
-	result := make([]nfsFs.FileInfo, len(entries))
-	for i, entry := range entries {
-		entryPath := path.Join(dirPath, entry.Name())
-		result[i] = newFileInfoWithPath(entry, entryPath, f.rootDir)
-	}
-	return result, nil
+	return entries, nil
 }
@@ -2,14 +2,16 @@ package ssh
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/user"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -19,7 +21,15 @@ import (
 var currentUID = uint32(501)
 var currentGID = uint32(20)
 
+// createMode is the mode Create gives new files: 0666 less the umask, as a
+// local open(2) would.
+var createMode os.FileMode = 0644
+
 func init() {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	createMode = 0666 &^ os.FileMode(umask)
+
 	if u, err := user.Current(); err == nil {
 		if uid, err := strconv.ParseUint(u.Uid, 10, 32); err == nil {
 			currentUID = uint32(uid)
@@ -35,63 +45,170 @@ type dirCacheEntry struct {
 	expiry  time.Time
 }
 
+// attrCacheEntry is the attributes of one child of a cached listing, so a
+// Stat of it after a READDIR needs no round trip.
+type attrCacheEntry struct {
+	info   os.FileInfo
+	expiry time.Time
+}
+
+// dirCacheTTL is how long a listing, and the attributes in it, are served
+// without asking the server again.
+const dirCacheTTL = 5 * time.Second
+
+// negCacheTTL bounds how long a path that returned ENOENT is reported
+// missing without asking the server again.
+const negCacheTTL = 2 * time.Second
+
 type SSHFS struct {
 	conn       *sftp.Client
 	client     *SSHClient
 	creds      nfsFs.Creds
 	rootDir    string
 	dirCache   map[string]dirCacheEntry
+	attrCache  map[string]attrCacheEntry // by full remote path
+	negCache   map[string]time.Time
+	ctimes     map[string]time.Time // see markChanged
 	dirCacheMu sync.Mutex
+	limiter    *rateLimiter
+	counters   counters
+	handles    *handleCache
+	readCache  *readCache // nil unless SetReadCache enabled it
+	noCache    bool       // see SetNoCache
+	readOnly   bool       // see SetReadOnly
+	rsize      int        // see SetIOSize
+	wsize      int
+	exactLinks bool          // see SetExactLinks
+	opTimeout  time.Duration // see SetOpTimeout
+	mtimeShift time.Duration // see SetMtimeShift
+	ignore     []string
+
+	// followSymlinks presents remote symlinks as their targets, so a link
+	// to a directory is a directory to NFS clients.
+	followSymlinks bool
+
+	// symlinkMode and localRoot drive symlink target rewriting, see
+	// SetSymlinkMode.
+	symlinkMode string
+	localRoot   string
+
+	onReconnect func()
+
+	// identity, when set, is used to present effective permissions, see
+	// EnableEffectivePerms.
+	identity *remoteIdentity
+
+	noFsyncWarning sync.Once
 }
 
 func (fs *SSHFS) reconnect() error {
-	log.Printf("SFTP connection lost, reconnecting...")
+	Infof("SFTP connection lost, reconnecting...")
 
 	if err := fs.client.EnsureConnected(); err != nil {
 		return fmt.Errorf("ssh reconnect failed: %w", err)
 	}
 
-	newConn, err := sftp.NewClient(fs.client.GetConn())
+	newConn, err := fs.client.NewSFTP()
 	if err != nil {
 		return err
 	}
 
 	fs.conn = newConn
 	fs.clearDirCache()
-	log.Printf("SFTP reconnected")
+	fs.handles.clear()
+	Infof("SFTP reconnected")
+	if fs.onReconnect != nil {
+		go fs.onReconnect()
+	}
 	return nil
 }
 
+// Reconnect replaces the SSH connection and SFTP session even if they look
+// healthy, for when the network is known to have changed. Unlike the
+// automatic reconnect it does not run the SetOnReconnect hook; the caller
+// deals with what follows.
+func (fs *SSHFS) Reconnect() error {
+	if err := fs.client.Reconnect(); err != nil {
+		return err
+	}
+	conn, err := fs.client.NewSFTP()
+	if err != nil {
+		return err
+	}
+	old := fs.conn
+	fs.conn = conn
+	if old != nil {
+		old.Close()
+	}
+	fs.clearDirCache()
+	fs.handles.clear()
+	return nil
+}
+
+// DefaultIOSize is the largest read and write NFS clients are told to
+// send by default: eight of pkg/sftp's 32 KiB packets, which it keeps in
+// flight at once, so each NFS request costs about one round trip.
+const DefaultIOSize = 256 * 1024
+
+// SetIOSize sets the largest read and write advertised to NFS clients,
+// which should match the rsize and wsize the mount asks for. Zero keeps
+// DefaultIOSize.
+func (fs *SSHFS) SetIOSize(rsize, wsize int) {
+	if rsize > 0 {
+		fs.rsize = rsize
+	}
+	if wsize > 0 {
+		fs.wsize = wsize
+	}
+}
+
+// SetOnReconnect registers fn to run, in its own goroutine, after each
+// successful SFTP reconnect.
+func (fs *SSHFS) SetOnReconnect(fn func()) {
+	fs.onReconnect = fn
+}
+
 func (fs *SSHFS) ensureConnected() error {
 	if fs.conn == nil {
 		return fs.reconnect()
 	}
-	_, err := fs.conn.Lstat(".")
+	conn := fs.conn
+	err := fs.withTimeout(conn, func() error {
+		_, err := conn.Lstat(".")
+		return err
+	})
 	if err != nil {
-		log.Printf("SFTP connection stale, reconnecting...")
+		Infof("SFTP connection stale, reconnecting...")
 		return fs.reconnect()
 	}
 	return nil
 }
 
+// maxOpAttempts bounds how often doWithReconnect runs an operation that
+// keeps failing with connection-level errors.
+const maxOpAttempts = 3
+
+// doWithReconnect runs fn, and while it fails with a retryable error (see
+// isRetryable) waits a little, reconnects if the SFTP session went stale and
+// tries again, up to maxOpAttempts in total.
 func (fs *SSHFS) doWithReconnect(fn func(*sftp.Client) error) error {
-	err := fn(fs.conn)
-	if err != nil {
-		errStr := err.Error()
-		if strings.Contains(errStr, "file does not exist") || strings.Contains(errStr, "no such file") {
+	for attempt := 1; ; attempt++ {
+		conn := fs.conn
+		err := fs.withTimeout(conn, func() error { return fn(conn) })
+		if err == nil || !isRetryable(err) || attempt == maxOpAttempts {
 			return err
 		}
-		log.Printf("SFTP operation failed: %v, reconnecting...", err)
-		if reerr := fs.reconnect(); reerr != nil {
+		delay := time.Duration(100<<(attempt-1)) * time.Millisecond
+		Warnf("SFTP operation failed: %v, retrying in %v", err, delay)
+		time.Sleep(delay)
+		if reerr := fs.ensureConnected(); reerr != nil {
 			return fmt.Errorf("operation failed: %v, reconnection failed: %w", err, reerr)
 		}
-		return fn(fs.conn)
 	}
-	return nil
 }
 
 func (c *SSHClient) NewFS(rootDir string) (*SSHFS, error) {
-	conn, err := sftp.NewClient(c.conn)
+	conn, err := c.NewSFTP()
 	if err != nil {
 		return nil, err
 	}
@@ -109,10 +226,155 @@ func (c *SSHClient) NewFS(rootDir string) (*SSHFS, error) {
 		}
 		rootDir = root
 	}
-	return &SSHFS{conn, c, nil, rootDir, make(map[string]dirCacheEntry), sync.Mutex{}}, nil
+	fs := &SSHFS{
+		conn:      conn,
+		client:    c,
+		rootDir:   rootDir,
+		dirCache:  make(map[string]dirCacheEntry),
+		attrCache: make(map[string]attrCacheEntry),
+		negCache:  make(map[string]time.Time),
+		ctimes:    make(map[string]time.Time),
+		handles:   newHandleCache(),
+		rsize:     DefaultIOSize,
+		wsize:     DefaultIOSize,
+		opTimeout: DefaultOpTimeout,
+	}
+	// A link recovered in the background gets its SFTP session back
+	// straight away too.
+	c.onReconnect = func() { fs.ensureConnected() }
+	fs.touch()
+	return fs, nil
+}
+
+// RootDir is the absolute remote directory the filesystem is rooted at.
+func (fs *SSHFS) RootDir() string {
+	return fs.rootDir
+}
+
+// CheckRoot verifies that the mounted remote directory exists and is a
+// directory, so a bad path fails up instead of the first client access.
+func (fs *SSHFS) CheckRoot() error {
+	info, err := fs.conn.Stat(fs.rootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("remote path does not exist: %s", fs.rootDir)
+		}
+		return fmt.Errorf("remote path %s: %w", fs.rootDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("remote path is not a directory: %s", fs.rootDir)
+	}
+	return nil
+}
+
+// SetRateLimit caps the combined read and write throughput of all files of
+// this filesystem. Zero means unlimited.
+func (fs *SSHFS) SetRateLimit(bytesPerSec int64) {
+	fs.limiter = newRateLimiter(bytesPerSec)
+}
+
+// SetIgnore hides every path with a component matching one of patterns
+// (path.Match syntax, e.g. "node_modules" or "*.pyc"): lookups report
+// ENOENT and directory listings leave them out.
+func (fs *SSHFS) SetIgnore(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("ignore pattern %q: %w", p, err)
+		}
+	}
+	fs.ignore = patterns
+	return nil
+}
+
+func (fs *SSHFS) isIgnored(fullPath string) bool {
+	rel := fullPath
+	if root := path.Clean(fs.rootDir); hasPathPrefix(fullPath, root) {
+		rel = strings.TrimPrefix(fullPath, root)
+	}
+	for _, name := range strings.Split(rel, "/") {
+		if name != "" && fs.matchesIgnore(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesIgnore reports whether name is hidden from the mount: it matches
+// --ignore, or is one of the lock directories of LockFile.
+func (fs *SSHFS) matchesIgnore(name string) bool {
+	if isLockName(name) {
+		return true
+	}
+	for _, p := range fs.ignore {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *SSHFS) filterIgnored(entries []os.FileInfo) []os.FileInfo {
+	kept := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if !fs.matchesIgnore(e.Name()) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// SetFollowSymlinks switches the mount from showing symlinks as links to
+// showing what they point at. Dangling links are still shown as links.
+func (fs *SSHFS) SetFollowSymlinks(follow bool) {
+	fs.followSymlinks = follow
+}
+
+// SetNoCache stops the mount from caching listings, attributes and missing
+// paths, so every lookup asks the server.
+func (fs *SSHFS) SetNoCache(off bool) {
+	fs.noCache = off
+	if off {
+		fs.clearDirCache()
+	}
+}
+
+// Refresh drops everything cached about the remote tree, so changes made
+// on the server show up at once. Cached file content is keyed by mtime
+// and needs no dropping.
+func (fs *SSHFS) Refresh() {
+	fs.clearDirCache()
+	fs.handles.clear()
+}
+
+// lstat is Lstat, or Stat when symlinks are followed.
+func (fs *SSHFS) lstat(conn *sftp.Client, p string) (os.FileInfo, error) {
+	if fs.followSymlinks {
+		if info, err := conn.Stat(p); err == nil {
+			return info, nil
+		}
+	}
+	return conn.Lstat(p)
+}
+
+// followLinks replaces symlink entries of a listing of fullDirPath with the
+// entries they point at when symlinks are followed.
+func (fs *SSHFS) followLinks(fullDirPath string, entries []os.FileInfo) []os.FileInfo {
+	if !fs.followSymlinks {
+		return entries
+	}
+	for i, e := range entries {
+		if e.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if info, err := fs.conn.Stat(path.Join(fullDirPath, e.Name())); err == nil {
+			entries[i] = info
+		}
+	}
+	return entries
 }
 
 func (fs *SSHFS) Close() error {
+	fs.handles.close()
 	if fs.conn != nil {
 		return fs.conn.Close()
 	}
@@ -124,17 +386,43 @@ func (fs *SSHFS) getDirCache(dirPath string) ([]os.FileInfo, bool) {
 	defer fs.dirCacheMu.Unlock()
 	entry, ok := fs.dirCache[dirPath]
 	if ok && time.Now().Before(entry.expiry) {
+		fs.counters.cacheHits.Add(1)
 		return entry.entries, true
 	}
+	fs.counters.cacheMisses.Add(1)
 	return nil, false
 }
 
+// setDirCache caches the listing of dirPath, and the attributes of each
+// entry under its full path.
 func (fs *SSHFS) setDirCache(dirPath string, entries []os.FileInfo) {
+	fs.setDirCacheTTL(dirPath, entries, dirCacheTTL)
+}
+
+func (fs *SSHFS) setDirCacheTTL(dirPath string, entries []os.FileInfo, ttl time.Duration) {
+	if fs.noCache {
+		return
+	}
 	fs.dirCacheMu.Lock()
 	defer fs.dirCacheMu.Unlock()
-	fs.dirCache[dirPath] = dirCacheEntry{
-		entries: entries,
-		expiry:  time.Now().Add(5 * time.Second),
+	fullDirPath := fs.resolvePath(dirPath)
+	if old, ok := fs.dirCache[dirPath]; ok {
+		for _, e := range old.entries {
+			delete(fs.attrCache, path.Join(fullDirPath, e.Name()))
+		}
+	}
+	entry := dirCacheEntry{
+		entries: fs.filterIgnored(entries),
+		expiry:  time.Now().Add(ttl),
+	}
+	fs.dirCache[dirPath] = entry
+	for _, e := range entry.entries {
+		fs.attrCache[path.Join(fullDirPath, e.Name())] = attrCacheEntry{info: e, expiry: entry.expiry}
+	}
+	for p := range fs.negCache {
+		if path.Dir(p) == fullDirPath {
+			delete(fs.negCache, p)
+		}
 	}
 }
 
@@ -142,13 +430,106 @@ func (fs *SSHFS) clearDirCache() {
 	fs.dirCacheMu.Lock()
 	defer fs.dirCacheMu.Unlock()
 	fs.dirCache = make(map[string]dirCacheEntry)
+	fs.attrCache = make(map[string]attrCacheEntry)
+	fs.negCache = make(map[string]time.Time)
+}
+
+// getAttrCache returns the cached attributes of fullPath from the listing
+// of its directory.
+func (fs *SSHFS) getAttrCache(fullPath string) (os.FileInfo, bool) {
+	fs.dirCacheMu.Lock()
+	defer fs.dirCacheMu.Unlock()
+	entry, ok := fs.attrCache[fullPath]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expiry) {
+		delete(fs.attrCache, fullPath)
+		return nil, false
+	}
+	fs.counters.cacheHits.Add(1)
+	return entry.info, true
+}
+
+func (fs *SSHFS) isKnownMissing(fullPath string) bool {
+	fs.dirCacheMu.Lock()
+	defer fs.dirCacheMu.Unlock()
+	expiry, ok := fs.negCache[fullPath]
+	if ok && time.Now().Before(expiry) {
+		return true
+	}
+	if ok {
+		delete(fs.negCache, fullPath)
+	}
+	return false
+}
+
+func (fs *SSHFS) setKnownMissing(fullPath string) {
+	if fs.noCache {
+		return
+	}
+	fs.dirCacheMu.Lock()
+	defer fs.dirCacheMu.Unlock()
+	fs.negCache[fullPath] = time.Now().Add(negCacheTTL)
+}
+
+func (fs *SSHFS) clearKnownMissing(fullPath string) {
+	fs.dirCacheMu.Lock()
+	defer fs.dirCacheMu.Unlock()
+	delete(fs.negCache, fullPath)
+}
+
+// markChanged records a metadata change of fullPath that leaves its mtime
+// alone, so CTime can report it.
+func (fs *SSHFS) markChanged(fullPath string) {
+	fs.dirCacheMu.Lock()
+	defer fs.dirCacheMu.Unlock()
+	fs.ctimes[fullPath] = time.Now()
+}
+
+// annotate attaches what the server does not report to fi: a recorded
+// metadata change of fullPath, the identity for effective permissions, a
+// directory's link count and the shift onto the local clock.
+// Change records that the mtime has caught up with are dropped.
+func (fs *SSHFS) annotate(fi nfsFs.FileInfo, fullPath string) nfsFs.FileInfo {
+	if w, ok := fi.(*fileInfo); ok {
+		w.identity = fs.identity
+		w.shift = fs.mtimeShift
+		if w.IsDir() {
+			w.links = fs.dirLinks(w.nfsPath, fullPath)
+		}
+	}
+	fs.dirCacheMu.Lock()
+	defer fs.dirCacheMu.Unlock()
+	changed, ok := fs.ctimes[fullPath]
+	if !ok {
+		return fi
+	}
+	if !changed.After(fi.ModTime()) {
+		delete(fs.ctimes, fullPath)
+		return fi
+	}
+	if w, ok := fi.(*fileInfo); ok {
+		w.changed = changed
+	}
+	return fi
 }
 
+// invalidateParentCache forgets what is cached about filePath after it was
+// created, removed, renamed or changed: the listing of its parent, its own
+// attributes and, for a directory, its own listing. Listings are cached
+// under mount-relative paths by lookups and under full remote paths by
+// READDIR, so both keys go.
 func (fs *SSHFS) invalidateParentCache(filePath string) {
-	dirPath, _ := fs.getParentDir(filePath)
+	dirPath, fullDirPath := fs.getParentDir(filePath)
+	fullPath := fs.resolvePath(filePath)
 	fs.dirCacheMu.Lock()
 	defer fs.dirCacheMu.Unlock()
 	delete(fs.dirCache, dirPath)
+	delete(fs.dirCache, fullDirPath)
+	delete(fs.dirCache, filePath)
+	delete(fs.dirCache, fullPath)
+	delete(fs.attrCache, fullPath)
 }
 
 func (fs *SSHFS) getParentDir(filePath string) (string, string) {
@@ -168,6 +549,10 @@ func (fs *SSHFS) findInCache(filePath string, dirPath string) (nfsFs.FileInfo, b
 	if filePath == "/" || filePath == "" {
 		return nil, false
 	}
+	fullPath := fs.resolvePath(filePath)
+	if info, ok := fs.getAttrCache(fullPath); ok {
+		return fs.annotate(newFileInfoWithPath(info, filePath, fs.rootDir), fullPath), true
+	}
 	entries, ok := fs.getDirCache(dirPath)
 	if !ok {
 		return nil, false
@@ -175,15 +560,22 @@ func (fs *SSHFS) findInCache(filePath string, dirPath string) (nfsFs.FileInfo, b
 	baseName := path.Base(filePath)
 	for _, e := range entries {
 		if e.Name() == baseName {
-			return newFileInfoWithPath(e, filePath, fs.rootDir), true
+			return fs.annotate(newFileInfoWithPath(e, filePath, fs.rootDir), fullPath), true
 		}
 	}
 	return nil, true // cache exists but file not found
 }
 
 func (fs *SSHFS) populateDirCache(dirPath, fullDirPath string) {
-	if entries, err := fs.conn.ReadDir(fullDirPath); err == nil {
-		fs.setDirCache(dirPath, entries)
+	fs.counters.readDirs.Add(1)
+	var entries []os.FileInfo
+	conn := fs.conn
+	err := fs.withTimeout(conn, func() (err error) {
+		entries, err = conn.ReadDir(fullDirPath)
+		return err
+	})
+	if err == nil {
+		fs.setDirCache(dirPath, fs.followLinks(fullDirPath, entries))
 	}
 }
 
@@ -191,27 +583,32 @@ func (fs *SSHFS) SetCreds(creds nfsFs.Creds) {
 	fs.creds = creds
 }
 
+// Create creates or truncates path with createMode, for callers that have
+// no mode of their own; NFS CREATE goes through OpenFile with the mode the
+// client sent.
 func (fs *SSHFS) Create(path string) (nfsFs.File, error) {
-	if err := fs.ensureConnected(); err != nil {
-		return nil, err
-	}
-	fullPath := fs.resolvePath(path)
-	handle, err := fs.conn.Create(fullPath)
-	if err != nil {
-		return nil, err
-	}
-	fs.invalidateParentCache(path)
-	return &file{handle, fs.conn, fs, false, fullPath, fs.rootDir}, nil
+	return fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, createMode)
 }
 
 func (fs *SSHFS) MkdirAll(dirPath string, mode os.FileMode) error {
+	if err := fs.writable("mkdir", dirPath); err != nil {
+		return err
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return err
 	}
-	fullPath := fs.resolvePath(dirPath)
-	if err := fs.conn.MkdirAll(fullPath); err != nil {
+	fullPath, err := fs.resolve(dirPath)
+	if err != nil {
 		return err
 	}
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		return conn.MkdirAll(fullPath)
+	})
+	if err != nil {
+		return toErrno("mkdir", fullPath, err)
+	}
+	fs.clearKnownMissing(fullPath)
+	fs.invalidateParentCache(dirPath)
 	fs.populateDirCache(path.Dir(dirPath), path.Dir(fullPath))
 	return nil
 }
@@ -220,18 +617,33 @@ func (fs *SSHFS) Open(filePath string) (nfsFs.File, error) {
 	if err := fs.ensureConnected(); err != nil {
 		return nil, err
 	}
-	fullPath := fs.resolvePath(filePath)
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if fs.isIgnored(fullPath) {
+		return nil, os.ErrNotExist
+	}
+	if h := fs.handles.acquire(fullPath); h != nil {
+		return &file{handle: h.handle, cached: h, client: fs.conn, fs: fs, fullPath: fullPath, rootDir: fs.rootDir}, nil
+	}
+	fs.counters.opens.Add(1)
 	var result nfsFs.File
-	err := fs.doWithReconnect(func(conn *sftp.Client) error {
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
 		handle, err := conn.Open(fullPath)
 		if err != nil {
 			return err
 		}
-		info, err := conn.Lstat(fullPath)
+		info, err := fs.lstat(conn, fullPath)
 		if err != nil {
 			handle.Close()
 			return err
 		}
+		if info.Mode().IsRegular() && !isRootPath(filePath, fs.rootDir) {
+			h := fs.handles.put(fullPath, handle, info)
+			result = &file{handle: handle, cached: h, client: conn, fs: fs, fullPath: fullPath, rootDir: fs.rootDir}
+			return nil
+		}
 		f, err := fs.newFile(handle, filePath, fullPath, info)
 		if err != nil {
 			return err
@@ -243,30 +655,88 @@ func (fs *SSHFS) Open(filePath string) (nfsFs.File, error) {
 }
 
 func (fs *SSHFS) OpenFile(filePath string, flag int, mode os.FileMode) (nfsFs.File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := fs.writable("open", filePath); err != nil {
+			return nil, err
+		}
+	}
+	if fs.readOnly {
+		// NFS OPEN asks for O_RDWR even to read, so open read-only on
+		// the server and leave refusing writes to Write and Truncate.
+		flag &^= os.O_WRONLY | os.O_RDWR
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return nil, err
 	}
-	fullPath := fs.resolvePath(filePath)
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		// Readers must not keep serving what is about to change,
+		// least of all from the read cache under the old mtime.
+		fs.handles.invalidate(fullPath)
+	}
 
+	fs.counters.opens.Add(1)
 	var result nfsFs.File
-	err := fs.doWithReconnect(func(conn *sftp.Client) error {
+	tried := false
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
 		var handle *sftp.File
 		var err error
-
-		if flag&os.O_CREATE != 0 {
-			handle, err = conn.Create(fullPath)
+		retry := tried
+		tried = true
+
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			// Let the server do the exclusive create atomically; v3
+			// servers report a clash as a bare failure, so check.
+			// Neither frontend gets here: libnfs-go answers a GUARDED
+			// or EXCLUSIVE OPEN by a Stat and then opens with
+			// O_CREATE|O_RDWR|O_TRUNC, so exclusive create over NFS
+			// is still racy, and WebDAV never asks for O_EXCL.
+			if retry {
+				// The first try may have created the file before
+				// the connection dropped, which can't be told from
+				// a clash with someone else's; don't guess.
+				return &os.PathError{Op: "create", Path: fullPath, Err: syscall.EIO}
+			}
+			handle, err = conn.OpenFile(fullPath, flag)
 			if err != nil {
-				return err
+				if _, statErr := conn.Lstat(fullPath); statErr == nil {
+					return &os.PathError{Op: "open", Path: fullPath, Err: os.ErrExist}
+				}
+				return toErrno("create", fullPath, err)
+			}
+			fs.clearKnownMissing(fullPath)
+			setCreateMode(handle, fullPath, mode)
+		} else if flag&os.O_CREATE != 0 {
+			// Try to create first so mode is only applied to a new
+			// file; an existing one is opened as is and truncated only
+			// when O_TRUNC asks for it.
+			handle, err = conn.OpenFile(fullPath, flag|os.O_EXCL)
+			if err == nil {
+				setCreateMode(handle, fullPath, mode)
+			} else if _, statErr := conn.Lstat(fullPath); statErr == nil {
+				handle, err = conn.OpenFile(fullPath, flag&^os.O_CREATE)
+			}
+			if err != nil {
+				return toErrno("create", fullPath, err)
 			}
-			conn.Chmod(fullPath, mode)
+			fs.clearKnownMissing(fullPath)
 		} else {
 			handle, err = conn.OpenFile(fullPath, flag)
 			if err != nil {
 				return err
 			}
 		}
+		if flag&os.O_APPEND != 0 {
+			if _, err := handle.Seek(0, io.SeekEnd); err != nil {
+				handle.Close()
+				return err
+			}
+		}
 
-		info, err := conn.Lstat(fullPath)
+		info, err := fs.lstat(conn, fullPath)
 		if err != nil {
 			handle.Close()
 			return err
@@ -275,19 +745,39 @@ func (fs *SSHFS) OpenFile(filePath string, flag int, mode os.FileMode) (nfsFs.Fi
 		if err != nil {
 			return err
 		}
+		f.(*file).append = flag&os.O_APPEND != 0
 		result = f
 		return nil
 	})
+	if err == nil && flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		fs.invalidateParentCache(filePath)
+	}
 	return result, err
 }
 
+// setCreateMode gives a file just created through handle the mode the
+// client asked for. SFTP servers create files with their own default,
+// often 0644, and pkg/sftp cannot pass attributes with the open, so this
+// follows on the handle at once; a 0600 file is briefly readable until it
+// does.
+func setCreateMode(handle *sftp.File, fullPath string, mode os.FileMode) {
+	if err := handle.Chmod(mode); err != nil {
+		Warnf("set mode %v on %s: %v", mode, fullPath, err)
+	}
+}
+
 func (fs *SSHFS) newFile(handle *sftp.File, filePath, fullPath string, info os.FileInfo) (nfsFs.File, error) {
 	isRoot := isRootPath(filePath, fs.rootDir)
 	isSymlink := info.Mode()&os.ModeSymlink != 0
-	return &file{handle, fs.conn, fs, isRoot || (info.IsDir() && !isSymlink), fullPath, fs.rootDir}, nil
+	isDir := isRoot || (info.IsDir() && !isSymlink)
+	return &file{handle: handle, client: fs.conn, fs: fs, isDir: isDir, fullPath: fullPath, rootDir: fs.rootDir}, nil
 }
 
 func (fs *SSHFS) Stat(filePath string) (nfsFs.FileInfo, error) {
+	fs.touch()
+	if _, err := fs.resolve(filePath); err != nil {
+		return nil, err
+	}
 	dirPath, fullDirPath := fs.getParentDir(filePath)
 
 	if info, inCache := fs.findInCache(filePath, dirPath); inCache {
@@ -298,21 +788,32 @@ func (fs *SSHFS) Stat(filePath string) (nfsFs.FileInfo, error) {
 	}
 
 	fullPath := fs.resolvePath(filePath)
+	if fs.isIgnored(fullPath) || fs.isKnownMissing(fullPath) {
+		return nil, os.ErrNotExist
+	}
+	fs.counters.stats.Add(1)
 	var result nfsFs.FileInfo
 	err := fs.doWithReconnect(func(conn *sftp.Client) error {
-		info, err := conn.Lstat(fullPath)
+		info, err := fs.lstat(conn, fullPath)
 		if err != nil {
 			fs.populateDirCache(dirPath, fullDirPath)
+			if os.IsNotExist(err) {
+				fs.setKnownMissing(fullPath)
+			}
 			return err
 		}
 		fs.populateDirCache(dirPath, fullDirPath)
-		result = newFileInfoWithPath(info, filePath, fs.rootDir)
+		result = fs.annotate(newFileInfoWithPath(info, filePath, fs.rootDir), fullPath)
 		return nil
 	})
 	return result, err
 }
 
 func (fs *SSHFS) Lstat(filePath string) (nfsFs.FileInfo, error) {
+	fs.touch()
+	if _, err := fs.resolve(filePath); err != nil {
+		return nil, err
+	}
 	dirPath, fullDirPath := fs.getParentDir(filePath)
 
 	if info, inCache := fs.findInCache(filePath, dirPath); inCache {
@@ -323,95 +824,290 @@ func (fs *SSHFS) Lstat(filePath string) (nfsFs.FileInfo, error) {
 	}
 
 	fullPath := fs.resolvePath(filePath)
+	if fs.isIgnored(fullPath) || fs.isKnownMissing(fullPath) {
+		return nil, os.ErrNotExist
+	}
+	fs.counters.stats.Add(1)
 	var result nfsFs.FileInfo
 	err := fs.doWithReconnect(func(conn *sftp.Client) error {
-		info, err := conn.Lstat(fullPath)
+		info, err := fs.lstat(conn, fullPath)
 		if err != nil {
 			fs.populateDirCache(dirPath, fullDirPath)
+			if os.IsNotExist(err) {
+				fs.setKnownMissing(fullPath)
+			}
 			return err
 		}
 		fs.populateDirCache(dirPath, fullDirPath)
-		result = newFileInfoWithPath(info, filePath, fs.rootDir)
+		result = fs.annotate(newFileInfoWithPath(info, filePath, fs.rootDir), fullPath)
 		return nil
 	})
 	return result, err
 }
 
 func (fs *SSHFS) Chmod(filePath string, mode os.FileMode) error {
+	if err := fs.writable("chmod", filePath); err != nil {
+		return err
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return err
 	}
-	fullPath := fs.resolvePath(filePath)
-	return fs.conn.Chmod(fullPath, mode)
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return err
+	}
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		return conn.Chmod(fullPath, mode)
+	})
+	if err == nil {
+		fs.markChanged(fullPath)
+		fs.invalidateParentCache(filePath)
+	}
+	return err
 }
 
 func (fs *SSHFS) Chown(filePath string, uid, gid int) error {
+	if err := fs.writable("chown", filePath); err != nil {
+		return err
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return err
 	}
-	fullPath := fs.resolvePath(filePath)
-	return fs.conn.Chown(fullPath, uid, gid)
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return err
+	}
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		return conn.Chown(fullPath, uid, gid)
+	})
+	if err == nil {
+		fs.markChanged(fullPath)
+		fs.invalidateParentCache(filePath)
+	}
+	return err
+}
+
+// Chtimes sets the access and modification times of filePath. NFS clients
+// cannot reach it: SETATTR in libnfs-go v0.0.7 only applies mode, size and
+// owner and drops time_access_set and time_modify_set, so touch -d, cp -p
+// and rsync -t through the mount leave the server's times as they are.
+// It is here for callers of SSHFS and for when the library passes times
+// on.
+func (fs *SSHFS) Chtimes(filePath string, atime, mtime time.Time) error {
+	if err := fs.writable("chtimes", filePath); err != nil {
+		return err
+	}
+	if err := fs.ensureConnected(); err != nil {
+		return err
+	}
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return err
+	}
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		return conn.Chtimes(fullPath, atime.Add(fs.mtimeShift), mtime.Add(fs.mtimeShift))
+	})
+	if err == nil {
+		fs.markChanged(fullPath)
+		fs.invalidateParentCache(filePath)
+	}
+	return err
 }
 
 func (fs *SSHFS) Symlink(oldname, newname string) error {
+	if err := fs.writable("symlink", newname); err != nil {
+		return err
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return err
 	}
-	fullNew := fs.resolvePath(newname)
-	return fs.conn.Symlink(oldname, fullNew)
+	fullNew, err := fs.resolve(newname)
+	if err != nil {
+		return err
+	}
+	target, err := fs.symlinkTarget(fullNew, oldname)
+	if err != nil {
+		return err
+	}
+	fs.clearKnownMissing(fullNew)
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		return conn.Symlink(target, fullNew)
+	})
+	if err == nil {
+		fs.invalidateParentCache(newname)
+	}
+	return err
 }
 
 func (fs *SSHFS) Readlink(filePath string) (string, error) {
 	if err := fs.ensureConnected(); err != nil {
 		return "", err
 	}
-	fullPath := fs.resolvePath(filePath)
-	return fs.conn.ReadLink(fullPath)
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return "", err
+	}
+	target, err := fs.conn.ReadLink(fullPath)
+	if err != nil {
+		return "", err
+	}
+	return fs.readlinkTarget(fullPath, target)
 }
 
 func (fs *SSHFS) Link(oldname, newname string) error {
+	if err := fs.writable("link", newname); err != nil {
+		return err
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return err
 	}
-	oldPath := fs.resolvePath(oldname)
-	newPath := fs.resolvePath(newname)
-	return fs.conn.Link(oldPath, newPath)
+	oldPath, err := fs.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	newPath, err := fs.resolve(newname)
+	if err != nil {
+		return err
+	}
+	fs.clearKnownMissing(newPath)
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		return conn.Link(oldPath, newPath)
+	})
+	if err == nil {
+		fs.markChanged(oldPath)
+		fs.invalidateParentCache(oldname)
+		fs.invalidateParentCache(newname)
+	}
+	return err
 }
 
 func (fs *SSHFS) Rename(oldname, newname string) error {
+	if err := fs.writable("rename", oldname); err != nil {
+		return err
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return err
 	}
-	oldPath := fs.resolvePath(oldname)
-	newPath := fs.resolvePath(newname)
-	err := fs.conn.Rename(oldPath, newPath)
+	oldPath, err := fs.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	newPath, err := fs.resolve(newname)
+	if err != nil {
+		return err
+	}
+	fs.clearKnownMissing(newPath)
+	err = fs.doWithReconnect(fs.renameAttempt(oldPath, newPath))
+	fs.handles.invalidate(oldPath)
+	fs.handles.invalidate(newPath)
 	if err == nil {
+		fs.markChanged(newPath)
 		fs.invalidateParentCache(oldname)
 		fs.invalidateParentCache(newname)
 	}
 	return err
 }
 
+// renameAttempt is one try of a rename for doWithReconnect. When a try is
+// retried the first may have gone through with only its reply lost, so a
+// retry that finds oldPath gone and newPath present reports success instead
+// of renaming again and failing with ENOENT.
+func (fs *SSHFS) renameAttempt(oldPath, newPath string) func(*sftp.Client) error {
+	tried := false
+	return func(conn *sftp.Client) error {
+		if tried {
+			_, oldErr := conn.Lstat(oldPath)
+			_, newErr := conn.Lstat(newPath)
+			if os.IsNotExist(oldErr) && newErr == nil {
+				return nil
+			}
+		}
+		tried = true
+		return rename(conn, oldPath, newPath)
+	}
+}
+
+// rename replaces newPath atomically when the server supports the
+// posix-rename extension. Plain SFTP rename refuses to overwrite, so without
+// the extension an existing destination is removed first, leaving a short
+// window where neither name exists.
+func rename(conn *sftp.Client, oldPath, newPath string) error {
+	if _, ok := conn.HasExtension("posix-rename@openssh.com"); ok {
+		return conn.PosixRename(oldPath, newPath)
+	}
+	err := conn.Rename(oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := conn.Lstat(newPath); statErr != nil {
+		return err
+	}
+	if rmErr := conn.Remove(newPath); rmErr != nil {
+		return err
+	}
+	return conn.Rename(oldPath, newPath)
+}
+
 func (fs *SSHFS) Remove(filePath string) error {
+	if err := fs.writable("remove", filePath); err != nil {
+		return err
+	}
 	if err := fs.ensureConnected(); err != nil {
 		return err
 	}
-	fullPath := fs.resolvePath(filePath)
-	err := fs.conn.Remove(fullPath)
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return err
+	}
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		isDir, err := fs.isRealDir(conn, fullPath)
+		if err != nil {
+			return err
+		}
+		if !isDir {
+			return conn.Remove(fullPath)
+		}
+		err = conn.RemoveDirectory(fullPath)
+		// OpenSSH reports a directory that is not empty as a plain
+		// failure; tell rmdir what went wrong.
+		var status *sftp.StatusError
+		if errors.As(err, &status) && status.Code == fxFailure {
+			if entries, rerr := conn.ReadDir(fullPath); rerr == nil && len(entries) > 0 {
+				return &os.PathError{Op: "rmdir", Path: fullPath, Err: syscall.ENOTEMPTY}
+			}
+		}
+		return toErrno("rmdir", fullPath, err)
+	})
+	fs.handles.invalidate(fullPath)
 	if err == nil {
 		fs.invalidateParentCache(filePath)
 	}
 	return err
 }
 
+// isRealDir reports whether fullPath is a directory itself, not a symlink
+// to one, from the cached listing when that cannot have followed links.
+func (fs *SSHFS) isRealDir(conn *sftp.Client, fullPath string) (bool, error) {
+	if !fs.followSymlinks {
+		if info, ok := fs.getAttrCache(fullPath); ok {
+			return info.IsDir(), nil
+		}
+	}
+	info, err := conn.Lstat(fullPath)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
 func (fs *SSHFS) Attributes() *nfsFs.Attributes {
 	return &nfsFs.Attributes{
 		LinkSupport:     true,
 		SymlinkSupport:  true,
 		ChownRestricted: false,
 		MaxName:         255,
-		MaxRead:         1024 * 1024 * 1024,
-		MaxWrite:        1024 * 1024 * 1024,
+		MaxRead:         uint64(fs.rsize),
+		MaxWrite:        uint64(fs.wsize),
 		NoTrunc:         true,
 	}
 }
@@ -484,7 +1180,7 @@ func (fs *SSHFS) resolvePath(p string) string {
 			return result
 		}
 
-		if strings.HasPrefix(p, cleanRoot) {
+		if hasPathPrefix(path.Clean(p), cleanRoot) {
 			result := path.Clean(p)
 			return result
 		}
@@ -498,6 +1194,36 @@ func (fs *SSHFS) resolvePath(p string) string {
 	return result
 }
 
+// resolve is resolvePath for paths from a client, which are refused with
+// os.ErrPermission when they resolve outside the root, whatever mix of
+// "..", "~/" and absolute prefixes they use.
+func (fs *SSHFS) resolve(p string) (string, error) {
+	full := fs.resolvePath(p)
+	if !withinRoot(full, path.Clean(fs.rootDir)) {
+		Warnf("refusing %q: resolves to %s, outside %s", p, full, fs.rootDir)
+		return "", &os.PathError{Op: "resolve", Path: p, Err: os.ErrPermission}
+	}
+	return full, nil
+}
+
+// withinRoot reports whether the resolved path p is root or below it. A
+// relative root of "." is the login directory, which p may not climb out of.
+func withinRoot(p, root string) bool {
+	if root == "." {
+		return !path.IsAbs(p) && p != ".." && !strings.HasPrefix(p, "../")
+	}
+	return hasPathPrefix(p, root)
+}
+
+// hasPathPrefix reports whether p is root or lies below it. Unlike
+// strings.HasPrefix, /srv/database is not under /srv/data.
+func hasPathPrefix(p, root string) bool {
+	if root == "/" {
+		return strings.HasPrefix(p, "/")
+	}
+	return p == root || strings.HasPrefix(p, root+"/")
+}
+
 func newFileInfo(info os.FileInfo) nfsFs.FileInfo {
 	return &fileInfo{info: info}
 }
@@ -507,9 +1233,13 @@ func newFileInfoWithPath(info os.FileInfo, nfsPath string, rootDir string) nfsFs
 }
 
 type fileInfo struct {
-	info    os.FileInfo
-	nfsPath string
-	rootDir string
+	info     os.FileInfo
+	nfsPath  string
+	rootDir  string
+	changed  time.Time       // metadata change made through this mount, if later than mtime
+	identity *remoteIdentity // see EnableEffectivePerms
+	links    int             // a directory's link count, see dirLinks; 0 if unknown
+	shift    time.Duration   // subtracted from the server's times, see SetMtimeShift
 }
 
 func (f *fileInfo) Name() string {
@@ -520,6 +1250,10 @@ func (f *fileInfo) Size() int64 {
 	return f.info.Size()
 }
 
+// Mode is the server's mode with its type bits as pkg/sftp decodes them,
+// pipes, sockets and devices included. libnfs-go v0.0.7 only maps
+// directories, symlinks and sockets to NFS types, so NFS clients still
+// see pipes and devices as regular files.
 func (f *fileInfo) Mode() os.FileMode {
 	mode := f.info.Mode()
 
@@ -538,11 +1272,17 @@ func (f *fileInfo) Mode() os.FileMode {
 		}
 	}
 
+	if f.identity != nil {
+		if perm, ok := f.identity.effectivePerm(f.info); ok {
+			mode = mode&^0700 | perm<<6
+		}
+	}
+
 	return mode
 }
 
 func (f *fileInfo) ModTime() time.Time {
-	return f.info.ModTime()
+	return f.info.ModTime().Add(-f.shift)
 }
 
 func (f *fileInfo) IsDir() bool {
@@ -565,25 +1305,36 @@ func (f *fileInfo) Sys() any {
 }
 
 func (f *fileInfo) ATime() time.Time {
-	sys := f.info.Sys()
-	if sys == nil {
-		return f.info.ModTime()
+	info := f.info
+	if inner, ok := info.(*fileInfo); ok {
+		info = inner.info
 	}
-
-	if st, ok := sys.(*sftp.FileStat); ok {
-		return time.Unix(int64(st.Atime), 0)
+	if st, ok := info.Sys().(*sftp.FileStat); ok && st.Atime != 0 {
+		return time.Unix(int64(st.Atime), 0).Add(-f.shift)
 	}
-
-	return f.info.ModTime()
+	return f.ModTime()
 }
 
+// CTime approximates the inode change time. SFTP v3 attributes carry no
+// ctime, so this is the modification time, or the time of a later chmod,
+// chown, link or rename done through this mount.
 func (f *fileInfo) CTime() time.Time {
-	return f.info.ModTime()
+	if f.changed.After(f.ModTime()) {
+		return f.changed
+	}
+	return f.ModTime()
 }
 
+// NumLinks is the link count, see nlink.go.
 func (f *fileInfo) NumLinks() int {
-	if f.info.IsDir() {
-		return 2
+	if p, ok := f.info.(*prewarmInfo); ok && p.nlink > 0 {
+		return p.nlink
+	}
+	if f.links > 0 {
+		return f.links
+	}
+	if inner, ok := f.info.(*fileInfo); ok {
+		return inner.NumLinks()
 	}
 	return 1
 }
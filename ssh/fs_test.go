@@ -0,0 +1,414 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// newLocalFS returns an SSHFS rooted at a temporary directory, talking to
+// an in-process SFTP server on the local filesystem.
+func newLocalFS(t *testing.T) (*SSHFS, string) {
+	t.Helper()
+	root := t.TempDir()
+	toServer, fromClient := io.Pipe()
+	fromServer, toClient := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{toServer, toClient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	conn, err := sftp.NewClientPipe(fromServer, fromClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &SSHFS{
+		conn:      conn,
+		rootDir:   root,
+		dirCache:  make(map[string]dirCacheEntry),
+		attrCache: make(map[string]attrCacheEntry),
+		negCache:  make(map[string]time.Time),
+		ctimes:    make(map[string]time.Time),
+		handles:   newHandleCache(),
+		rsize:     DefaultIOSize,
+		wsize:     DefaultIOSize,
+	}
+	t.Cleanup(func() {
+		fs.handles.close()
+		server.Close()
+		conn.Close()
+	})
+	return fs, root
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		p, root string
+		want    bool
+	}{
+		{"/srv/data", "/srv/data", true},
+		{"/srv/data/x", "/srv/data", true},
+		{"/srv/database", "/srv/data", false},
+		{"/srv/database/x", "/srv/data", false},
+		{"/srv", "/srv/data", false},
+		{"/", "/", true},
+		{"/etc/passwd", "/", true},
+		{"etc", "/", false},
+	}
+	for _, tt := range tests {
+		if got := hasPathPrefix(tt.p, tt.root); got != tt.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", tt.p, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		root, p, want string
+	}{
+		{"/srv/data", "/", "/srv/data"},
+		{"/srv/data", "x", "/srv/data/x"},
+		{"/srv/data", "/x", "/srv/data/x"},
+		{"/srv/data", "/srv/data/x", "/srv/data/x"},
+		{"/srv/data", "/srv/database/x", "/srv/data/srv/database/x"},
+		{"/srv/data", "/srv/data/../database/x", "/srv/data/srv/database/x"},
+		{"/srv/data", "~/x", "/srv/data/x"},
+		{"/", "/etc/passwd", "/etc/passwd"},
+		{"/", "x/../y", "/y"},
+	}
+	for _, tt := range tests {
+		fs := &SSHFS{rootDir: tt.root}
+		if got := fs.resolvePath(tt.p); got != tt.want {
+			t.Errorf("root %s: resolvePath(%q) = %q, want %q", tt.root, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestWithinRoot(t *testing.T) {
+	tests := []struct {
+		p, root string
+		want    bool
+	}{
+		{"/srv/data/x", "/srv/data", true},
+		{"/srv/database/x", "/srv/data", false},
+		{"/srv", "/srv/data", false},
+		{"/anything", "/", true},
+		{"x/y", ".", true},
+		{".", ".", true},
+		{"..", ".", false},
+		{"../x", ".", false},
+		{"/etc", ".", false},
+	}
+	for _, tt := range tests {
+		if got := withinRoot(tt.p, tt.root); got != tt.want {
+			t.Errorf("withinRoot(%q, %q) = %v, want %v", tt.p, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestReadlinkTargetContain(t *testing.T) {
+	fs := &SSHFS{rootDir: "/srv/data", symlinkMode: SymlinksContain}
+	tests := []struct {
+		target string
+		want   string
+		err    error
+	}{
+		{"/srv/data/a/b", "a/b", nil},
+		{"a/b", "a/b", nil},
+		{"/srv/database/x", "", os.ErrPermission},
+		{"../database/x", "", os.ErrPermission},
+		{"/etc/passwd", "", os.ErrPermission},
+	}
+	for _, tt := range tests {
+		got, err := fs.readlinkTarget("/srv/data/link", tt.target)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("readlinkTarget(%q) = %q, %v; want %q, %v", tt.target, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestResolveRefusesEscapes(t *testing.T) {
+	tests := []struct {
+		root, p, want string
+	}{
+		{"/srv/data", "x/../y", "/srv/data/y"},
+		{"/srv/data", "/srv/database", "/srv/data/srv/database"},
+		{"/srv/data", "..", ""},
+		{"/srv/data", "../database/x", ""},
+		{"/srv/data", "x/../../etc", ""},
+		{"/srv/data", "~/../database", ""},
+		{"/srv/data", "/../../etc", ""},
+		{".", "x/y", "x/y"},
+		{".", "../x", ""},
+		{".", "/../x", ""},
+		{"/", "/../../etc", "/etc"},
+	}
+	for _, tt := range tests {
+		fs := &SSHFS{rootDir: tt.root}
+		got, err := fs.resolve(tt.p)
+		if tt.want == "" {
+			if !errors.Is(err, os.ErrPermission) {
+				t.Errorf("root %s: resolve(%q) = %q, %v; want os.ErrPermission", tt.root, tt.p, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("root %s: resolve(%q) = %q, %v; want %q", tt.root, tt.p, got, err, tt.want)
+		}
+	}
+}
+
+func TestOpenFileFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		flag   int
+		exists bool
+		want   string
+	}{
+		{"append", os.O_WRONLY | os.O_CREATE | os.O_APPEND, true, "old content\nnew\n"},
+		{"append creates", os.O_WRONLY | os.O_CREATE | os.O_APPEND, false, "new\n"},
+		{"create keeps content", os.O_WRONLY | os.O_CREATE, true, "new\ncontent\n"},
+		{"create", os.O_WRONLY | os.O_CREATE, false, "new\n"},
+		{"trunc", os.O_WRONLY | os.O_CREATE | os.O_TRUNC, true, "new\n"},
+		{"append without create", os.O_WRONLY | os.O_APPEND, true, "old content\nnew\n"},
+		{"plain write", os.O_WRONLY, true, "new\ncontent\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, root := newLocalFS(t)
+			local := filepath.Join(root, "log")
+			if tt.exists {
+				if err := os.WriteFile(local, []byte("old content\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := fs.OpenFile("/log", tt.flag, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("new\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateMode(t *testing.T) {
+	fs, root := newLocalFS(t)
+	for _, mode := range []os.FileMode{0600, 0640, 0755} {
+		name := "f" + mode.String()
+		f, err := fs.OpenFile("/"+name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != mode {
+			t.Errorf("created with %v, got %v", mode, got)
+		}
+	}
+
+	// An existing file keeps its mode.
+	existing := filepath.Join(root, "existing")
+	if err := os.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("/existing", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	info, err := os.Stat(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0644 {
+		t.Errorf("existing file mode = %v, want 0644 unchanged", got)
+	}
+
+	// Create, which has no mode of its own, uses 0666 less the umask.
+	f, err = fs.Create("/created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	info, err = os.Stat(filepath.Join(root, "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != createMode {
+		t.Errorf("Create made mode %v, want %v", got, createMode)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	fs, root := newLocalFS(t)
+	for _, dir := range []string{"empty", "full", "target"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"file", "full/child"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("target", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		gone bool
+	}{
+		{"file", nil, true},
+		{"empty", nil, true},
+		{"link", nil, true},
+		{"full", syscall.ENOTEMPTY, false},
+		{"missing", os.ErrNotExist, true},
+	}
+	for _, tt := range tests {
+		err := fs.Remove("/" + tt.name)
+		if !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+			t.Errorf("Remove(%s) = %v, want %v", tt.name, err, tt.err)
+		}
+		_, statErr := os.Lstat(filepath.Join(root, tt.name))
+		if gone := os.IsNotExist(statErr); gone != tt.gone {
+			t.Errorf("after Remove(%s) gone = %v, want %v", tt.name, gone, tt.gone)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "target")); err != nil {
+		t.Errorf("removing the link removed its target: %v", err)
+	}
+}
+
+func TestDoWithReconnect(t *testing.T) {
+	fs, _ := newLocalFS(t)
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   error
+	}{
+		{"succeeds", 0, nil, 1, nil},
+		{"recovers", 2, sftp.ErrSSHFxConnectionLost, 3, nil},
+		{"gives up", maxOpAttempts, sftp.ErrSSHFxConnectionLost, maxOpAttempts, sftp.ErrSSHFxConnectionLost},
+		{"not found", 1, os.ErrNotExist, 1, os.ErrNotExist},
+		{"denied", 1, os.ErrPermission, 1, os.ErrPermission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := fs.doWithReconnect(func(*sftp.Client) error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("called %d times, want %d", calls, tt.wantCalls)
+			}
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenameRetryAfterLostReply(t *testing.T) {
+	fs, root := newLocalFS(t)
+	oldPath, newPath := filepath.Join(root, "old"), filepath.Join(root, "new")
+	if err := os.WriteFile(oldPath, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	attempt := fs.renameAttempt(oldPath, newPath)
+	calls := 0
+	err := fs.doWithReconnect(func(conn *sftp.Client) error {
+		calls++
+		err := attempt(conn)
+		if calls == 1 && err == nil {
+			// The rename went through, but the reply never came.
+			return sftp.ErrSSHFxConnectionLost
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("rename reported %v after it succeeded", err)
+	}
+	if calls != 2 {
+		t.Fatalf("called %d times, want 2", calls)
+	}
+	if _, err := os.Stat(newPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutationsDropParentListing(t *testing.T) {
+	fs, root := newLocalFS(t)
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "old"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Lookups key listings by the mount-relative path, READDIR and
+	// Prewarm by the full remote path.
+	keys := []string{"/sub", filepath.Join(root, "sub")}
+
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"create", func() error {
+			f, err := fs.OpenFile("/sub/new", os.O_RDWR|os.O_CREATE, 0644)
+			if err == nil {
+				f.Close()
+			}
+			return err
+		}},
+		{"rename", func() error { return fs.Rename("/sub/new", "/sub/renamed") }},
+		{"remove", func() error { return fs.Remove("/sub/renamed") }},
+		{"mkdir", func() error { return fs.MkdirAll("/sub/dir", 0755) }},
+	}
+	for _, tt := range tests {
+		// MkdirAll lists the parent again at once, so look for the stale
+		// entry rather than for any.
+		stale := time.Now().Add(time.Hour)
+		for _, key := range keys {
+			fs.dirCache[key] = dirCacheEntry{expiry: stale}
+		}
+		if err := tt.op(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, key := range keys {
+			if entry, ok := fs.dirCache[key]; ok && entry.expiry.Equal(stale) {
+				t.Errorf("%s left the stale listing cached under %s", tt.name, key)
+			}
+		}
+	}
+}
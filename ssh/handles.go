@@ -0,0 +1,147 @@
+package ssh
+
+import (
+	"container/list"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	maxCachedHandles  = 64
+	handleIdleTimeout = 5 * time.Second
+)
+
+// cachedHandle is a read-only sftp handle shared by every file opened on
+// the same path. Users read with ReadAt at their own offset, so sharing
+// never disturbs another reader's position.
+type cachedHandle struct {
+	path     string
+	handle   *sftp.File
+	info     os.FileInfo
+	refs     int
+	lastUsed time.Time
+	elem     *list.Element
+	dead     bool // evicted or invalidated; closed when refs drops to 0
+}
+
+// handleCache keeps recently opened read-only handles so that the
+// open/stat/read/close sequences the NFS backend issues for one file reuse
+// a single SFTP open. Unused handles are closed after handleIdleTimeout or
+// when the cache grows past maxCachedHandles.
+type handleCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedHandle
+	lru     *list.List // front is most recently used
+	done    chan struct{}
+}
+
+func newHandleCache() *handleCache {
+	c := &handleCache{
+		entries: make(map[string]*cachedHandle),
+		lru:     list.New(),
+		done:    make(chan struct{}),
+	}
+	go c.reapIdle()
+	return c
+}
+
+func (c *handleCache) acquire(path string) *cachedHandle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.entries[path]
+	if !ok {
+		return nil
+	}
+	h.refs++
+	c.lru.MoveToFront(h.elem)
+	return h
+}
+
+// put adds a freshly opened handle with one reference held by the caller.
+func (c *handleCache) put(path string, handle *sftp.File, info os.FileInfo) *cachedHandle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[path]; ok {
+		c.dropLocked(old)
+	}
+	h := &cachedHandle{path: path, handle: handle, info: info, refs: 1}
+	h.elem = c.lru.PushFront(h)
+	c.entries[path] = h
+
+	for e := c.lru.Back(); e != nil && len(c.entries) > maxCachedHandles; {
+		prev := e.Prev()
+		if victim := e.Value.(*cachedHandle); victim.refs == 0 {
+			c.dropLocked(victim)
+		}
+		e = prev
+	}
+	return h
+}
+
+func (c *handleCache) release(h *cachedHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.refs--
+	h.lastUsed = time.Now()
+	if h.dead && h.refs == 0 {
+		h.handle.Close()
+	}
+}
+
+// invalidate drops the handles for path and anything below it, e.g. after
+// a remove or rename, so the next Open goes back to the server.
+func (c *handleCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p, h := range c.entries {
+		if p == path || strings.HasPrefix(p, prefix) {
+			c.dropLocked(h)
+		}
+	}
+}
+
+func (c *handleCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.entries {
+		c.dropLocked(h)
+	}
+}
+
+func (c *handleCache) close() {
+	close(c.done)
+	c.clear()
+}
+
+func (c *handleCache) dropLocked(h *cachedHandle) {
+	delete(c.entries, h.path)
+	c.lru.Remove(h.elem)
+	h.dead = true
+	if h.refs == 0 {
+		h.handle.Close()
+	}
+}
+
+func (c *handleCache) reapIdle() {
+	ticker := time.NewTicker(handleIdleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		for _, h := range c.entries {
+			if h.refs == 0 && time.Since(h.lastUsed) > handleIdleTimeout {
+				c.dropLocked(h)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
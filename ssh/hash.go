@@ -0,0 +1,50 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SHA256 returns the hex SHA-256 of the remote file p, relative to the
+// login directory unless absolute. It runs sha256sum, or shasum where that
+// is missing, on the server so the file does not cross the network, and
+// streams the file through a local hasher over SFTP when neither works.
+func (c *SSHClient) SHA256(p string) (string, error) {
+	if err := c.EnsureConnected(); err != nil {
+		return "", err
+	}
+	if p == "~" {
+		p = "."
+	}
+	p = strings.TrimPrefix(p, "~/")
+
+	q := "'" + strings.ReplaceAll(p, "'", `'\''`) + "'"
+	var out bytes.Buffer
+	command := fmt.Sprintf("sha256sum -- %s 2>/dev/null || shasum -a 256 -- %s 2>/dev/null", q, q)
+	if code, err := c.Run(command, &out, io.Discard); err == nil && code == 0 {
+		if fields := strings.Fields(out.String()); len(fields) > 0 && len(fields[0]) == sha256.Size*2 {
+			return fields[0], nil
+		}
+	}
+
+	Debugf("no remote sha256 tool for %s, hashing over SFTP", p)
+	sc, err := c.NewSFTP()
+	if err != nil {
+		return "", err
+	}
+	defer sc.Close()
+	f, err := sc.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := f.WriteTo(h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
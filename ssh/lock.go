@@ -0,0 +1,146 @@
+package ssh
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTP has no locking, so remote locks follow a lockfile convention: the
+// lock on dir/name is the directory dir/.name.rfs-lock, taken with mkdir,
+// which servers perform atomically. Every rfs mount of the tree, on any
+// host, thereby sees the others' locks; programs on the server do not.
+// Locks are exclusive and cover the whole file. The holder touches the
+// directory every lockRefresh, and a lock left untouched for lockStale,
+// because its holder died or lost the network, may be broken.
+const (
+	lockSuffix  = ".rfs-lock"
+	lockRefresh = time.Minute
+	lockStale   = 3 * time.Minute
+)
+
+// ErrLocked is returned by LockFile when another client holds the lock.
+var ErrLocked = errors.New("locked by another client")
+
+// RemoteLock is a lock taken with LockFile.
+type RemoteLock struct {
+	fs    *SSHFS
+	dir   string
+	mu    sync.Mutex
+	until time.Time // refreshed until then; zero means until Unlock
+	done  chan struct{}
+	once  sync.Once
+}
+
+func lockDir(fullPath string) string {
+	return path.Join(path.Dir(fullPath), "."+path.Base(fullPath)+lockSuffix)
+}
+
+// isLockName reports whether a directory entry is a lock, which listings
+// leave out.
+func isLockName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, lockSuffix)
+}
+
+// LockFile takes the remote lock on filePath, which is kept for d, or
+// until Unlock when d is not positive.
+func (fs *SSHFS) LockFile(filePath string, d time.Duration) (*RemoteLock, error) {
+	if err := fs.writable("lock", filePath); err != nil {
+		return nil, err
+	}
+	if err := fs.ensureConnected(); err != nil {
+		return nil, err
+	}
+	fullPath, err := fs.resolve(filePath)
+	if err != nil {
+		return nil, err
+	}
+	dir := lockDir(fullPath)
+	err = fs.doWithReconnect(func(conn *sftp.Client) error {
+		err := conn.Mkdir(dir)
+		if err == nil {
+			return nil
+		}
+		info, statErr := conn.Lstat(dir)
+		if statErr != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < lockStale {
+			return ErrLocked
+		}
+		Warnf("breaking stale lock %s, untouched since %v", dir, info.ModTime().Format(time.RFC3339))
+		if err := conn.RemoveDirectory(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := conn.Mkdir(dir); err != nil {
+			return ErrLocked
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RemoteLock{fs: fs, dir: dir, done: make(chan struct{})}
+	l.Extend(d)
+	go l.refresh()
+	return l, nil
+}
+
+// Extend keeps the lock for d from now, or until Unlock when d is not
+// positive.
+func (l *RemoteLock) Extend(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if d > 0 {
+		l.until = time.Now().Add(d)
+	} else {
+		l.until = time.Time{}
+	}
+}
+
+// refresh touches the lock until it is released or runs out, after which
+// it goes stale for others to break.
+func (l *RemoteLock) refresh() {
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			expired := !l.until.IsZero() && now.After(l.until)
+			l.mu.Unlock()
+			if expired {
+				continue
+			}
+			err := l.fs.doWithReconnect(func(conn *sftp.Client) error {
+				return conn.Chtimes(l.dir, now, now)
+			})
+			if err != nil {
+				Warnf("refresh lock %s: %v", l.dir, err)
+			}
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *RemoteLock) Unlock() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.fs.doWithReconnect(func(conn *sftp.Client) error {
+			return conn.RemoveDirectory(l.dir)
+		})
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	})
+	return err
+}
@@ -0,0 +1,70 @@
+package ssh
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel orders log messages by severity; messages below the current
+// level are dropped.
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLogLevel accepts debug, info, warn (or warning) and error.
+func ParseLogLevel(s string) (LogLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range levelNames {
+		if s == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LevelInfo))
+}
+
+// SetLogLevel changes the level for the whole process. Output still goes
+// wherever the standard log package is pointed.
+func SetLogLevel(l LogLevel) {
+	logLevel.Store(int32(l))
+}
+
+func GetLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+func logf(l LogLevel, format string, args ...any) {
+	if l < GetLogLevel() {
+		return
+	}
+	log.Output(3, strings.ToUpper(l.String())+" "+fmt.Sprintf(format, args...))
+}
+
+func Debugf(format string, args ...any) { logf(LevelDebug, format, args...) }
+func Infof(format string, args ...any)  { logf(LevelInfo, format, args...) }
+func Warnf(format string, args ...any)  { logf(LevelWarn, format, args...) }
+func Errorf(format string, args ...any) { logf(LevelError, format, args...) }
@@ -0,0 +1,61 @@
+package ssh
+
+import (
+	"os"
+	"time"
+)
+
+// SFTP v3 attributes carry no link count, so NumLinks is assembled from
+// what the mount does know: a directory has 2 links plus one per
+// subdirectory, countable from its cached listing, and Prewarm's find
+// reports the real count of everything it lists. Anything else has 1,
+// which find and fts take to mean unknown, where a directory's usual 2
+// would tell them it has no subdirectories to descend into.
+
+// SetExactLinks makes directories whose listing is not cached list it to
+// count their subdirectories, at the cost of a READDIR for each, instead
+// of reporting 1.
+func (fs *SSHFS) SetExactLinks(on bool) {
+	fs.exactLinks = on
+}
+
+// dirLinks is the link count of the directory cached under either key,
+// or 0 when it is not known.
+func (fs *SSHFS) dirLinks(nfsPath, fullPath string) int {
+	entries, ok := fs.cachedListing(nfsPath, fullPath)
+	if !ok {
+		if !fs.exactLinks || fs.conn == nil {
+			return 0
+		}
+		fs.counters.readDirs.Add(1)
+		list, err := fs.conn.ReadDir(fullPath)
+		if err != nil {
+			return 0
+		}
+		list = fs.followLinks(fullPath, list)
+		fs.setDirCache(fullPath, list)
+		entries = fs.filterIgnored(list)
+	}
+	n := 2
+	for _, e := range entries {
+		if e.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+// cachedListing is the unexpired listing cached under any of keys, which
+// may be mount-relative or full remote paths. It does not count towards
+// the cache statistics, being no lookup the client asked for.
+func (fs *SSHFS) cachedListing(keys ...string) ([]os.FileInfo, bool) {
+	fs.dirCacheMu.Lock()
+	defer fs.dirCacheMu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if entry, ok := fs.dirCache[key]; ok && now.Before(entry.expiry) {
+			return entry.entries, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,177 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// prewarmTTL is how long listings from Prewarm are served. It outlasts
+// the usual listing TTL so a scan started after mounting finds them.
+const prewarmTTL = 30 * time.Second
+
+// prewarmFormat prints one NUL-terminated record per file for GNU find:
+// type, permissions, size, mtime, atime, owner, group, link count and the
+// path relative to the root, last as it may hold spaces.
+const prewarmFormat = `%y %m %s %T@ %A@ %U %G %n %P\0`
+
+// Prewarm lists the tree under the root with a single remote find, rather
+// than a READDIR per directory, and caches every listing it completes for
+// prewarmTTL. It stops after maxEntries; directories still being listed
+// at that point are left uncached. It returns how many entries it read.
+// Servers without GNU find are reported as an error.
+func (fs *SSHFS) Prewarm(maxEntries int) (int, error) {
+	if fs.noCache || maxEntries <= 0 {
+		return 0, nil
+	}
+	session, err := fs.client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	root := "'" + strings.ReplaceAll(fs.rootDir, "'", `'\''`) + "'"
+	if err := session.Start(fmt.Sprintf("find %s -mindepth 1 -printf '%s'", root, prewarmFormat)); err != nil {
+		return 0, err
+	}
+
+	// Listings by directory, relative to the root, "." being the root.
+	// find descends into a directory right after printing it, so once
+	// the output stops early only the directories leading to the last
+	// record can be incomplete.
+	dirs := map[string][]os.FileInfo{".": nil}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(splitNUL)
+	n, last, truncated := 0, "", false
+	for scanner.Scan() {
+		if n == maxEntries {
+			truncated = true
+			break
+		}
+		rel, info, ok := parsePrewarmRecord(scanner.Text())
+		if !ok {
+			continue
+		}
+		n++
+		last = rel
+		if fs.ignoredPath(rel) {
+			continue
+		}
+		parent := path.Dir(rel)
+		dirs[parent] = append(dirs[parent], info)
+		if info.IsDir() {
+			if _, ok := dirs[rel]; !ok {
+				dirs[rel] = nil
+			}
+		}
+	}
+	if !truncated {
+		if err := session.Wait(); err != nil && n == 0 {
+			return 0, fmt.Errorf("remote find: %v %s", err, strings.TrimSpace(stderr.String()))
+		}
+	}
+	if truncated || scanner.Err() != nil {
+		for p := last; ; p = path.Dir(p) {
+			delete(dirs, p)
+			if p == "." || p == "/" {
+				break
+			}
+		}
+	}
+
+	for rel, entries := range dirs {
+		fullDirPath := path.Join(fs.rootDir, rel)
+		if entries == nil {
+			entries = []os.FileInfo{}
+		}
+		fs.setDirCacheTTL(fullDirPath, fs.followLinks(fullDirPath, entries), prewarmTTL)
+	}
+	return n, nil
+}
+
+// ignoredPath reports whether any element of rel is hidden, see
+// matchesIgnore.
+func (fs *SSHFS) ignoredPath(rel string) bool {
+	for _, name := range strings.Split(rel, "/") {
+		if fs.matchesIgnore(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileTypeBits maps find's %y letters to the type bits of a POSIX mode.
+var fileTypeBits = map[byte]uint32{
+	'f': 0o100000,
+	'd': 0o040000,
+	'l': 0o120000,
+	'p': 0o010000,
+	's': 0o140000,
+	'c': 0o020000,
+	'b': 0o060000,
+}
+
+func parsePrewarmRecord(rec string) (string, os.FileInfo, bool) {
+	fields := strings.SplitN(rec, " ", 9)
+	if len(fields) != 9 || len(fields[0]) != 1 {
+		return "", nil, false
+	}
+	typ, ok := fileTypeBits[fields[0][0]]
+	perm, err1 := strconv.ParseUint(fields[1], 8, 32)
+	size, err2 := strconv.ParseUint(fields[2], 10, 64)
+	mtime, err3 := strconv.ParseFloat(fields[3], 64)
+	atime, err4 := strconv.ParseFloat(fields[4], 64)
+	uid, err5 := strconv.ParseUint(fields[5], 10, 32)
+	gid, err6 := strconv.ParseUint(fields[6], 10, 32)
+	nlink, err7 := strconv.Atoi(fields[7])
+	if !ok || err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || err6 != nil || err7 != nil {
+		return "", nil, false
+	}
+	rel := fields[8]
+	return rel, &prewarmInfo{name: path.Base(rel), nlink: nlink, stat: &sftp.FileStat{
+		Size:  size,
+		Mode:  typ | uint32(perm),
+		Mtime: uint32(mtime),
+		Atime: uint32(atime),
+		UID:   uint32(uid),
+		GID:   uint32(gid),
+	}}, true
+}
+
+func splitNUL(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// prewarmInfo is a file as reported by find, shaped like the FileInfo
+// pkg/sftp returns so the rest of the mount treats both alike.
+type prewarmInfo struct {
+	name  string
+	nlink int
+	stat  *sftp.FileStat
+}
+
+func (i *prewarmInfo) Name() string       { return i.name }
+func (i *prewarmInfo) Size() int64        { return int64(i.stat.Size) }
+func (i *prewarmInfo) Mode() os.FileMode  { return i.stat.FileMode() }
+func (i *prewarmInfo) ModTime() time.Time { return i.stat.ModTime() }
+func (i *prewarmInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i *prewarmInfo) Sys() any           { return i.stat }
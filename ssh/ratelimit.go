@@ -0,0 +1,43 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every file of a mount. Callers
+// take tokens for the bytes they move and sleep off any deficit, so the
+// bucket can go into debt for a single large transfer.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, also the burst size
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// readCacheBlock is the unit file content is cached in. Reads are widened
+// to whole blocks so nearby reads of the same file share entries.
+const readCacheBlock = 128 * 1024
+
+// readCache keeps blocks of remote files on local disk, named by a hash of
+// the path, size, mtime and block number, so a changed file simply stops
+// matching its old blocks. The least recently used blocks are removed once
+// the total passes max. The index is rebuilt from the directory on start,
+// so the cache outlives the daemon.
+type readCache struct {
+	dir  string
+	max  int64
+	mu   sync.Mutex
+	size int64
+	lru  *list.List // of *readCacheEntry, front is most recently used
+	keys map[string]*list.Element
+}
+
+type readCacheEntry struct {
+	key  string
+	size int64
+}
+
+func newReadCache(dir string, max int64) (*readCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &readCache{dir: dir, max: max, lru: list.New(), keys: make(map[string]*list.Element)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		entry   readCacheEntry
+		modTime time.Time
+	}
+	var blocks []found
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if filepath.Ext(e.Name()) == ".tmp" {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		blocks = append(blocks, found{readCacheEntry{e.Name(), info.Size()}, info.ModTime()})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].modTime.After(blocks[j].modTime) })
+	for _, b := range blocks {
+		entry := b.entry
+		c.keys[entry.key] = c.lru.PushBack(&entry)
+		c.size += entry.size
+	}
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func readCacheKey(path string, size int64, mtime time.Time, block int64) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%d\x00%d\x00%d", path, size, mtime.UnixNano(), block))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *readCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	elem, ok := c.keys[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		c.remove(key)
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *readCache) put(key string, data []byte) {
+	if int64(len(data)) > c.max {
+		return
+	}
+	tmp := filepath.Join(c.dir, key+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		Debugf("read cache: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.keys[key]; ok {
+		c.size -= elem.Value.(*readCacheEntry).size
+		c.lru.Remove(elem)
+	}
+	c.keys[key] = c.lru.PushFront(&readCacheEntry{key, int64(len(data))})
+	c.size += int64(len(data))
+	c.evictLocked()
+}
+
+func (c *readCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.keys[key]; ok {
+		c.dropLocked(elem)
+	}
+}
+
+func (c *readCache) evictLocked() {
+	for c.size > c.max {
+		elem := c.lru.Back()
+		if elem == nil {
+			return
+		}
+		c.dropLocked(elem)
+	}
+}
+
+func (c *readCache) dropLocked(elem *list.Element) {
+	entry := elem.Value.(*readCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.keys, entry.key)
+	c.size -= entry.size
+	os.Remove(filepath.Join(c.dir, entry.key))
+}
+
+// SetReadCache keeps up to maxBytes of file content read through the
+// mount in dir, see readCache. maxBytes 0 disables it.
+func (fs *SSHFS) SetReadCache(dir string, maxBytes int64) error {
+	if maxBytes <= 0 {
+		fs.readCache = nil
+		return nil
+	}
+	c, err := newReadCache(dir, maxBytes)
+	if err != nil {
+		return fmt.Errorf("read cache: %w", err)
+	}
+	fs.readCache = c
+	return nil
+}
+
+// readAt reads from a cached handle at off, through the read cache when
+// there is one.
+func (f *file) readAt(p []byte, off int64) (int, error) {
+	c := f.fs.readCache
+	if c == nil {
+		return f.handle.ReadAt(p, off)
+	}
+	block := off / readCacheBlock
+	start := block * readCacheBlock
+	info := f.cached.info
+	key := readCacheKey(f.fullPath, info.Size(), info.ModTime(), block)
+
+	data, ok := c.get(key)
+	if ok {
+		f.fs.counters.cacheHits.Add(1)
+	} else {
+		buf := make([]byte, readCacheBlock)
+		n, err := f.handle.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		data = buf[:n]
+		c.put(key, data)
+	}
+
+	if off-start >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off-start:])
+	if n < len(p) && len(data) < readCacheBlock {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,22 @@
+package ssh
+
+import (
+	"os"
+	"syscall"
+)
+
+// SetReadOnly makes the mount refuse every change to the remote tree with
+// EROFS, for browsing a tree, such as a server's whole filesystem, without
+// the risk of touching it. Files are still opened for reading, as NFS
+// OPEN always asks for read-write access; the writes themselves fail.
+func (fs *SSHFS) SetReadOnly(on bool) {
+	fs.readOnly = on
+}
+
+// writable fails op on p when the mount is read-only.
+func (fs *SSHFS) writable(op, p string) error {
+	if fs.readOnly {
+		return &os.PathError{Op: op, Path: p, Err: syscall.EROFS}
+	}
+	return nil
+}
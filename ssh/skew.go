@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MeasureClockSkew estimates how far the server's clock runs ahead of the
+// local one, negative when it is behind, by asking date(1) for the time
+// and comparing it with the middle of the round trip. It needs a shell, so
+// it fails on sftp-only accounts. The result is rounded to the second;
+// date without %N support only answers in whole seconds.
+func (c *SSHClient) MeasureClockSkew() (time.Duration, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	start := time.Now()
+	out, err := session.Output("date +%s.%N")
+	rtt := time.Since(start)
+	if err != nil {
+		return 0, fmt.Errorf("remote date: %w", err)
+	}
+	return clockSkew(string(out), start, rtt)
+}
+
+// clockSkew compares the output of date +%s.%N, asked for at start and
+// answered rtt later, with the local time halfway through.
+func clockSkew(out string, start time.Time, rtt time.Duration) (time.Duration, error) {
+	remote, err := parseRemoteTime(strings.TrimSpace(out))
+	if err != nil {
+		return 0, err
+	}
+	return remote.Sub(start.Add(rtt / 2)).Round(time.Second), nil
+}
+
+// parseRemoteTime reads date +%s.%N. Where %N is not supported the
+// fraction is not a number, and the middle of the second is assumed.
+func parseRemoteTime(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("remote date: unexpected output %q", s)
+	}
+	nsec := int64(time.Second / 2)
+	if len(frac) == 9 {
+		if n, err := strconv.ParseInt(frac, 10, 64); err == nil {
+			nsec = n
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// SetMtimeShift moves every time the mount reports by -skew, the server's
+// clock minus the local one as MeasureClockSkew finds it, and times given
+// to Chtimes by +skew. Build tools comparing remote mtimes with local ones
+// then agree with the server about what is newer. NFS clients cannot set
+// times, see Chtimes, so only the reported times matter to them.
+func (fs *SSHFS) SetMtimeShift(skew time.Duration) {
+	fs.mtimeShift = skew
+}
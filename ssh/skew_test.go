@@ -0,0 +1,69 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name string
+		out  string
+		rtt  time.Duration
+		want time.Duration
+	}{
+		{"in sync", "1000.100000000\n", 200 * time.Millisecond, 0},
+		{"ahead", "1060.500000000\n", time.Second, time.Minute},
+		{"behind", "940.500000000\n", time.Second, -time.Minute},
+		{"midpoint", "1002.000000000\n", 4 * time.Second, 0},
+		{"no %N", "1030.N\n", time.Second, 30 * time.Second},
+		{"literal %N", "1030.%N\n", time.Second, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		got, err := clockSkew(tt.out, start, tt.rtt)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: clockSkew(%q) = %v, %v; want %v", tt.name, tt.out, got, err, tt.want)
+		}
+	}
+	if _, err := clockSkew("date: illegal option\n", start, time.Second); err == nil {
+		t.Error("accepted output that is not a time")
+	}
+}
+
+func TestMtimeShift(t *testing.T) {
+	remote := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, skew := range []time.Duration{time.Hour, -time.Hour} {
+		fs, root := newLocalFS(t)
+		fs.SetMtimeShift(skew)
+		local := filepath.Join(root, "f")
+		if err := os.WriteFile(local, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(local, remote, remote); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := fs.Stat("/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := remote.Add(-skew); !info.ModTime().Equal(want) {
+			t.Errorf("skew %v: reported mtime %v, want %v", skew, info.ModTime(), want)
+		}
+
+		set := time.Date(2025, 6, 7, 8, 9, 10, 0, time.UTC)
+		if err := fs.Chtimes("/f", set, set); err != nil {
+			t.Fatal(err)
+		}
+		st, err := os.Stat(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := set.Add(skew); !st.ModTime().Equal(want) {
+			t.Errorf("skew %v: stored mtime %v, want %v", skew, st.ModTime(), want)
+		}
+	}
+}
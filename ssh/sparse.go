@@ -0,0 +1,71 @@
+package ssh
+
+import "io"
+
+// sparseMin is the shortest run of zeros Write leaves as a hole.
+const sparseMin = 64 * 1024
+
+// SFTP v3 can neither find nor punch holes, so sparseness is kept on the
+// way in only: a write of zeros that lands entirely past the end of the
+// file is skipped, since the server fills such a gap with zeros anyway, on
+// most filesystems as a hole. The size it would have given the file is
+// remembered in holeEnd and set by fillHole before anyone can observe it.
+
+// skipHole reports whether p, about to be written at the handle's offset,
+// is left as a hole. The offset is then moved past it as if written.
+func (f *file) skipHole(p []byte) bool {
+	if f.cached != nil || len(p) < sparseMin || !isZero(p) {
+		return false
+	}
+	off, err := f.handle.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false
+	}
+	if !f.eofKnown {
+		info, err := f.handle.Stat()
+		if err != nil {
+			return false
+		}
+		f.eof, f.eofKnown = info.Size(), true
+	}
+	if off < f.eof {
+		return false
+	}
+	end := off + int64(len(p))
+	if _, err := f.handle.Seek(end, io.SeekStart); err != nil {
+		return false
+	}
+	f.holeEnd = max(f.holeEnd, end)
+	return true
+}
+
+// wrote records that data now reaches the handle's offset.
+func (f *file) wrote() {
+	if !f.eofKnown {
+		return
+	}
+	if off, err := f.handle.Seek(0, io.SeekCurrent); err == nil {
+		f.eof = max(f.eof, off)
+	}
+}
+
+// fillHole extends the file over skipped trailing zeros.
+func (f *file) fillHole() error {
+	if f.holeEnd <= f.eof {
+		return nil
+	}
+	if err := f.handle.Truncate(f.holeEnd); err != nil {
+		return err
+	}
+	f.eof = f.holeEnd
+	return nil
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
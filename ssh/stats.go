@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of an SSHFS's operation counters.
+type Stats struct {
+	BytesRead    int64 `json:"bytesRead"`
+	BytesWritten int64 `json:"bytesWritten"`
+	Opens        int64 `json:"opens"`
+	Stats        int64 `json:"stats"`
+	ReadDirs     int64 `json:"readDirs"`
+	CacheHits    int64 `json:"cacheHits"`
+	CacheMisses  int64 `json:"cacheMisses"`
+
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// CacheHitRatio is the share of directory cache lookups served from memory.
+func (s Stats) CacheHitRatio() float64 {
+	total := s.CacheHits + s.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(total)
+}
+
+type counters struct {
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	opens        atomic.Int64
+	stats        atomic.Int64
+	readDirs     atomic.Int64
+	cacheHits    atomic.Int64
+	cacheMisses  atomic.Int64
+	lastActive   atomic.Int64 // unix nanoseconds
+}
+
+// touch records client activity for idle detection.
+func (fs *SSHFS) touch() {
+	fs.counters.lastActive.Store(time.Now().UnixNano())
+}
+
+// LastActivity is when a client last read, wrote, stat'ed or listed
+// anything, or when the filesystem was created if it hasn't yet.
+func (fs *SSHFS) LastActivity() time.Time {
+	return time.Unix(0, fs.counters.lastActive.Load())
+}
+
+func (fs *SSHFS) Stats() Stats {
+	c := &fs.counters
+	return Stats{
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+		Opens:        c.opens.Load(),
+		Stats:        c.stats.Load(),
+		ReadDirs:     c.readDirs.Load(),
+		CacheHits:    c.cacheHits.Load(),
+		CacheMisses:  c.cacheMisses.Load(),
+		LastActivity: fs.LastActivity(),
+	}
+}
@@ -0,0 +1,99 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink modes, chosen with SetSymlinkMode.
+const (
+	// SymlinksRaw passes targets through untouched, so an absolute target
+	// is resolved by the NFS client against the local filesystem.
+	SymlinksRaw = "raw"
+	// SymlinksRelative turns absolute targets inside the mounted tree into
+	// relative ones, so they resolve inside the mount. Targets outside the
+	// tree are passed through.
+	SymlinksRelative = "relative"
+	// SymlinksContain is SymlinksRelative, but links whose target leaves the
+	// mounted tree can be neither read nor created.
+	SymlinksContain = "contain"
+)
+
+// SetSymlinkMode selects how symlink targets are rewritten. localRoot is
+// where the tree is mounted locally; absolute targets under it in newly
+// created links are mapped to the remote tree. It may be empty.
+func (fs *SSHFS) SetSymlinkMode(mode, localRoot string) error {
+	switch mode {
+	case "":
+		mode = SymlinksRaw
+	case SymlinksRaw, SymlinksRelative, SymlinksContain:
+	default:
+		return fmt.Errorf("unknown symlink mode %q (want %s, %s or %s)", mode, SymlinksRaw, SymlinksRelative, SymlinksContain)
+	}
+	fs.symlinkMode = mode
+	if localRoot != "" {
+		localRoot = path.Clean(localRoot)
+	}
+	fs.localRoot = localRoot
+	return nil
+}
+
+// readlinkTarget rewrites the target of the remote link at linkPath for
+// the NFS client.
+func (fs *SSHFS) readlinkTarget(linkPath, target string) (string, error) {
+	if fs.symlinkMode == "" || fs.symlinkMode == SymlinksRaw {
+		return target, nil
+	}
+	root := path.Clean(fs.rootDir)
+	dir := path.Dir(linkPath)
+	abs := target
+	if !path.IsAbs(abs) {
+		abs = path.Join(dir, abs)
+	}
+	if !hasPathPrefix(path.Clean(abs), root) {
+		if fs.symlinkMode == SymlinksContain {
+			return "", &os.PathError{Op: "readlink", Path: linkPath, Err: os.ErrPermission}
+		}
+		return target, nil
+	}
+	if !path.IsAbs(target) {
+		return target, nil
+	}
+	return relTarget(dir, abs), nil
+}
+
+// symlinkTarget rewrites a target given by the NFS client before the link
+// at linkPath is created on the server.
+func (fs *SSHFS) symlinkTarget(linkPath, target string) (string, error) {
+	if fs.symlinkMode == "" || fs.symlinkMode == SymlinksRaw {
+		return target, nil
+	}
+	root := path.Clean(fs.rootDir)
+	dir := path.Dir(linkPath)
+	if path.IsAbs(target) {
+		clean := path.Clean(target)
+		if fs.localRoot != "" && hasPathPrefix(clean, fs.localRoot) {
+			remote := path.Join(root, strings.TrimPrefix(clean, fs.localRoot))
+			return relTarget(dir, remote), nil
+		}
+		if fs.symlinkMode == SymlinksContain {
+			return "", &os.PathError{Op: "symlink", Path: linkPath, Err: os.ErrPermission}
+		}
+		return target, nil
+	}
+	if fs.symlinkMode == SymlinksContain && !hasPathPrefix(path.Join(dir, target), root) {
+		return "", &os.PathError{Op: "symlink", Path: linkPath, Err: os.ErrPermission}
+	}
+	return target, nil
+}
+
+func relTarget(dir, target string) string {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,43 @@
+package ssh
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// DefaultOpTimeout bounds a single SFTP request unless SetOpTimeout says
+// otherwise.
+const DefaultOpTimeout = time.Minute
+
+// SetOpTimeout bounds every SFTP request on the NFS request path. A server
+// that stalls without dropping the connection, which keepalives do not
+// notice, would otherwise hang the client for good; after d the SFTP
+// session is closed, the request fails and the next one reconnects. Zero
+// or less waits forever.
+func (fs *SSHFS) SetOpTimeout(d time.Duration) {
+	fs.opTimeout = d
+}
+
+// withTimeout runs fn, a request on conn, closing conn if fn has not
+// returned within the op timeout so that it does. The error then says the
+// request timed out, which doWithReconnect retries on a new session.
+func (fs *SSHFS) withTimeout(conn *sftp.Client, fn func() error) error {
+	if fs.opTimeout <= 0 || conn == nil {
+		return fn()
+	}
+	var expired atomic.Bool
+	timer := time.AfterFunc(fs.opTimeout, func() {
+		expired.Store(true)
+		Warnf("SFTP request stalled for %v, closing the session", fs.opTimeout)
+		conn.Close()
+	})
+	err := fn()
+	timer.Stop()
+	if expired.Load() {
+		return fmt.Errorf("SFTP request timed out after %v: %w", fs.opTimeout, sftp.ErrSSHFxConnectionLost)
+	}
+	return err
+}
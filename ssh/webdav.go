@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	nfsFs "github.com/smallfz/libnfs-go/fs"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV exposes the filesystem through the webdav.FileSystem interface,
+// for clients such as Windows that can mount WebDAV but not NFS.
+func (fs *SSHFS) WebDAV() webdav.FileSystem {
+	return davFS{fs}
+}
+
+type davFS struct {
+	fs *SSHFS
+}
+
+// davPath turns a WebDAV path, always absolute, into one relative to the
+// mounted root.
+func davPath(name string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := d.fs.Stat(davPath(name)); err == nil {
+		return os.ErrExist
+	}
+	return d.fs.MkdirAll(davPath(name), perm)
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	var f nfsFs.File
+	var err error
+	if flag == os.O_RDONLY {
+		f, err = d.fs.Open(davPath(name))
+	} else {
+		f, err = d.fs.OpenFile(davPath(name), flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return davFile{f}, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	p := davPath(name)
+	info, err := d.fs.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+		dir, err := d.fs.Open(p)
+		if err != nil {
+			return err
+		}
+		entries, err := dir.Readdir(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := d.RemoveAll(ctx, path.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return d.fs.Remove(p)
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return d.fs.Rename(davPath(oldName), davPath(newName))
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return d.fs.Stat(davPath(name))
+}
+
+// davFile adapts the NFS-facing file to webdav.File, whose Readdir and
+// Stat return plain os.FileInfo.
+type davFile struct {
+	nfsFs.File
+}
+
+func (f davFile) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	infos := make([]os.FileInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e
+	}
+	return infos, err
+}
+
+func (f davFile) Stat() (os.FileInfo, error) {
+	return f.File.Stat()
+}
+
+// WebDAVLocks is the lock system for WebDAV: webdav's in-memory locks,
+// each also taken as a remote lock (see LockFile) on the locked resource,
+// so clients of other mounts of the tree are kept out too. A lock on a
+// directory is taken on the directory alone, not on what is below it.
+func (fs *SSHFS) WebDAVLocks() webdav.LockSystem {
+	return &davLocks{LockSystem: webdav.NewMemLS(), fs: fs, remote: make(map[string]*RemoteLock)}
+}
+
+type davLocks struct {
+	webdav.LockSystem
+	fs     *SSHFS
+	mu     sync.Mutex
+	remote map[string]*RemoteLock // by token
+}
+
+func (l *davLocks) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	rl, err := l.fs.LockFile(davPath(details.Root), details.Duration)
+	if errors.Is(err, ErrLocked) {
+		return "", webdav.ErrLocked
+	}
+	if err != nil {
+		return "", err
+	}
+	token, err := l.LockSystem.Create(now, details)
+	if err != nil {
+		rl.Unlock()
+		return "", err
+	}
+	l.mu.Lock()
+	l.remote[token] = rl
+	l.mu.Unlock()
+	return token, nil
+}
+
+func (l *davLocks) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := l.LockSystem.Refresh(now, token, duration)
+	if err == nil {
+		l.mu.Lock()
+		if rl, ok := l.remote[token]; ok {
+			rl.Extend(duration)
+		}
+		l.mu.Unlock()
+	}
+	return details, err
+}
+
+func (l *davLocks) Unlock(now time.Time, token string) error {
+	err := l.LockSystem.Unlock(now, token)
+	l.mu.Lock()
+	rl, ok := l.remote[token]
+	delete(l.remote, token)
+	l.mu.Unlock()
+	if ok {
+		if uerr := rl.Unlock(); uerr != nil {
+			Warnf("release remote lock: %v", uerr)
+		}
+	}
+	return err
+}